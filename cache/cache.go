@@ -1,16 +1,35 @@
 package cache
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 )
 
 type Cache struct {
-	Dir  string
+	Dir string
+
+	// Done receives the result of each Write, Read and Delete, if nothing is
+	// waiting on it already.
 	Done chan error
+
+	// MaxBytes, if set, is the largest file Read and ReadLinks will read.
+	MaxBytes int64
+}
+
+// TooLargeError is returned when a cached file is larger than MaxBytes.
+type TooLargeError struct {
+	Path  string
+	Limit int64
+}
+
+func (err *TooLargeError) Error() string {
+	return fmt.Sprintf("Cached file %s is larger than %d bytes.", err.Path, err.Limit)
 }
 
 func DefaultPath() (string, error) {
@@ -37,7 +56,7 @@ func NewCache(dir string) (*Cache, error) {
 			return nil, err
 		}
 	}
-	return &Cache{withDir, make(chan error, 1)}, nil
+	return &Cache{Dir: withDir, Done: make(chan error, 1)}, nil
 }
 
 func (cache *Cache) Write(envkeyParam string, body []byte) error {
@@ -65,7 +84,7 @@ func (cache *Cache) Write(envkeyParam string, body []byte) error {
 
 func (cache *Cache) Read(envkeyParam string) ([]byte, error) {
 	path := filepath.Join(cache.Dir, envkeyParam)
-	b, err := ioutil.ReadFile(path)
+	b, err := cache.readFile(path)
 	select {
 	case cache.Done <- err:
 	default:
@@ -73,12 +92,68 @@ func (cache *Cache) Read(envkeyParam string) ([]byte, error) {
 	return b, err
 }
 
+// Delete removes the cached response for an envkey along with its verified
+// links memo.
 func (cache *Cache) Delete(envkeyParam string) error {
 	path := filepath.Join(cache.Dir, envkeyParam)
 	err := os.Remove(path)
+	linksErr := os.Remove(cache.linksPath(envkeyParam))
+	if err == nil && linksErr != nil && !os.IsNotExist(linksErr) {
+		err = linksErr
+	}
 	select {
 	case cache.Done <- err:
 	default:
 	}
 	return err
 }
+
+// WriteLinks persists the verified trust links memo for an envkey. Unlike
+// Write, it doesn't signal Done.
+func (cache *Cache) WriteLinks(envkeyParam string, body []byte) error {
+	err := os.MkdirAll(cache.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cache.linksPath(envkeyParam), body, 0600)
+}
+
+func (cache *Cache) ReadLinks(envkeyParam string) ([]byte, error) {
+	return cache.readFile(cache.linksPath(envkeyParam))
+}
+
+// readFile reads at most MaxBytes, so a file that grows while it's read is
+// still bounded.
+func (cache *Cache) readFile(path string) ([]byte, error) {
+	if cache.MaxBytes <= 0 {
+		return ioutil.ReadFile(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(f, cache.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > cache.MaxBytes {
+		return nil, &TooLargeError{path, cache.MaxBytes}
+	}
+	return b, nil
+}
+
+func (cache *Cache) linksPath(envkeyParam string) string {
+	return filepath.Join(cache.Dir, envkeyParam+".links")
+}
+
+func (cache *Cache) Age(envkeyParam string) (time.Duration, error) {
+	path := filepath.Join(cache.Dir, envkeyParam)
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(info.ModTime()), nil
+}
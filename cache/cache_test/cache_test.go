@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/envkey/envkey-fetch/cache"
 
@@ -75,4 +76,45 @@ func TestDelete(t *testing.T) {
 	_, err = ioutil.ReadFile(filepath.Join(testPath, "some-envkey"))
 	assert.NotNil(t, err, "Should have removed the cache file.")
 
+	writeCache.Write("some-envkey", []byte("test data"))
+	writeCache.WriteLinks("some-envkey", []byte("links"))
+	err = c.Delete("some-envkey")
+	assert.Nil(t, err, "Should not return an error.")
+	_, err = writeCache.ReadLinks("some-envkey")
+	assert.NotNil(t, err, "Should have removed the verified links file.")
+}
+
+func TestAge(t *testing.T) {
+	var err error
+
+	c, _ := cache.NewCache(testPath)
+	c.Write("some-envkey", []byte("test data"))
+
+	age, err := c.Age("some-envkey")
+	assert.Nil(t, err, "Should not return an error.")
+	assert.True(t, age >= 0 && age < time.Minute, "Should return the time since the cache was written.")
+
+	c.Delete("some-envkey")
+	_, err = c.Age("some-envkey")
+	assert.NotNil(t, err, "Should return an error for a missing cache file.")
+}
+
+func TestReadMaxBytes(t *testing.T) {
+	c, _ := cache.NewCache(testPath)
+	c.Write("large-envkey", []byte("0123456789"))
+	defer os.Remove(filepath.Join(testPathExpanded, "large-envkey"))
+	<-c.Done
+
+	c.MaxBytes = 10
+	res, err := c.Read("large-envkey")
+	assert.Nil(t, err, "Should read a file at the limit.")
+	assert.Equal(t, "0123456789", string(res))
+	<-c.Done
+
+	c.MaxBytes = 9
+	_, err = c.Read("large-envkey")
+	var tooLarge *cache.TooLargeError
+	if assert.ErrorAs(t, err, &tooLarge, "Should not read a file over the limit.") {
+		assert.Equal(t, int64(9), tooLarge.Limit)
+	}
 }
@@ -0,0 +1,63 @@
+// Copyright © 2017 Envkey Inc. <support@envkey.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/envkey/envkey-fetch/fetch"
+
+	"github.com/spf13/cobra"
+)
+
+var responseFile string
+var decryptAt string
+
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt --response FILE YOUR-ENVKEY",
+	Short: "Decrypts and verifies a saved response from the EnvKey host, or a cache file, without any network access, with the same validation and trust verification as a fetch.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		options, err := fetchOptions()
+		if err != nil {
+			fatal(err)
+		}
+
+		var at time.Time
+		if decryptAt != "" {
+			at, err = time.Parse(time.RFC3339, decryptAt)
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		res, err := fetch.DecryptFile(args[0], responseFile, at, options)
+		printResult(res, err)
+	},
+}
+
+func init() {
+	decryptCmd.Flags().StringVar(&responseFile, "response", "", "file with the saved response")
+	decryptCmd.MarkFlagRequired("response")
+	decryptCmd.Flags().StringVar(&decryptAt, "at", "", "RFC 3339 time to verify keys and signatures at (default is now)")
+	addOutputFlags(decryptCmd)
+	RootCmd.AddCommand(decryptCmd)
+}
@@ -0,0 +1,123 @@
+// Copyright © 2017 Envkey Inc. <support@envkey.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/envkey/envkey-fetch/envkeytest"
+	"github.com/envkey/envkey-fetch/parser"
+
+	"github.com/spf13/cobra"
+)
+
+var fixtureEnv string
+var fixtureEnvFile string
+var fixtureOverrides string
+var fixtureKeyables []string
+var fixtureOptions envkeytest.FixtureOptions
+var fixtureBreak string
+var fixtureOut string
+
+var genFixtureCmd = &cobra.Command{
+	Use:   "gen-fixture",
+	Short: "Generates a new ENVKEY and a matching encrypted and signed response for a json env, with freshly generated keys for its web of trust, for testing EnvKey clients offline.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		options := fixtureOptions
+		options.Env = fixtureEnv
+		options.InheritanceOverrides = fixtureOverrides
+		options.Break = envkeytest.Break(fixtureBreak)
+
+		if fixtureEnvFile != "" {
+			env, err := ioutil.ReadFile(fixtureEnvFile)
+			if err != nil {
+				fatal(err)
+			}
+			options.Env = string(env)
+		}
+
+		for _, s := range fixtureKeyables {
+			split := strings.SplitN(s, "=", 2)
+			keyable := envkeytest.Keyable{Id: split[0]}
+			if len(split) == 2 {
+				keyable.InvitedBy = split[1]
+				if keyable.InvitedBy == "" {
+					fatal(errors.New("invalid keyable, expected id or id=inviter: " + s))
+				}
+			}
+			options.Keyables = append(options.Keyables, keyable)
+		}
+
+		fixture, err := envkeytest.NewFixture(options)
+		if err != nil {
+			fatal(err)
+		}
+
+		response, err := parser.EncodeResponse(fixture.Response, apiVersion)
+		if err != nil {
+			fatal(err)
+		}
+
+		if fixtureOut != "" {
+			err = ioutil.WriteFile(fixtureOut, response, 0600)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Println(fixture.Envkey)
+			return
+		}
+
+		out, err := json.Marshal(struct {
+			Envkey   string          `json:"envkey"`
+			Response json.RawMessage `json:"response"`
+		}{fixture.Envkey, response})
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(string(out))
+	},
+}
+
+func init() {
+	breaks := make([]string, len(envkeytest.Breaks))
+	for i, b := range envkeytest.Breaks {
+		breaks[i] = string(b)
+	}
+
+	genFixtureCmd.Flags().StringVar(&fixtureEnv, "env", "{}", "json env to encrypt")
+	genFixtureCmd.Flags().StringVar(&fixtureEnvFile, "env-file", "", "file with the json env to encrypt, instead of --env")
+	genFixtureCmd.Flags().StringVar(&fixtureOverrides, "inheritance-overrides", "", "json inheritance overrides to encrypt (default is none)")
+	genFixtureCmd.Flags().StringSliceVar(&fixtureKeyables, "keyable", nil, "id of a root keyable or id=inviter of an invited one, may be repeated (default is a single root, owner)")
+	genFixtureCmd.Flags().StringVar(&fixtureOptions.Signer, "signer", "", "id of the keyable that signs the env (default is the last keyable)")
+	genFixtureCmd.Flags().StringVar(&fixtureOptions.InheritanceOverridesSigner, "inheritance-overrides-signer", "", "id of the keyable that signs inheritance overrides (default is the signer)")
+	genFixtureCmd.Flags().StringVar(&fixtureOptions.Id, "id", "", "envkey id (default is random)")
+	genFixtureCmd.Flags().StringVar(&fixtureOptions.Passphrase, "passphrase", "", "envkey passphrase (default is random)")
+	genFixtureCmd.Flags().StringVar(&fixtureOptions.Host, "host", "", "host to append to the envkey, e.g. localhost:3000 for serve-mock (default is none)")
+	genFixtureCmd.Flags().BoolVar(&fixtureOptions.AllowCaching, "allow-caching", true, "allow clients to cache the response")
+	genFixtureCmd.Flags().StringVar(&fixtureBreak, "break", "", "generate a variant that fails to verify: "+strings.Join(breaks, ", "))
+	genFixtureCmd.Flags().StringVar(&fixtureOut, "out", "", "write the response to a file and print only the envkey (default prints both as json)")
+	RootCmd.AddCommand(genFixtureCmd)
+}
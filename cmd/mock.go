@@ -0,0 +1,100 @@
+// Copyright © 2017 Envkey Inc. <support@envkey.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/envkey/envkey-fetch/envkeytest"
+
+	"github.com/spf13/cobra"
+)
+
+var mockAddr string
+var mockResponses []string
+var mockFaults envkeytest.Faults
+var mockFaultRoutes []string
+
+var serveMockCmd = &cobra.Command{
+	Use:   "serve-mock",
+	Short: "Serves encrypted config responses from local files as a mock EnvKey host, optionally injecting latency, errors, and bad responses, for end-to-end testing of clients.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		handler := envkeytest.NewHandler()
+
+		if len(mockResponses) == 0 {
+			fatal(errors.New("at least one --response is required"))
+		}
+		for _, s := range mockResponses {
+			split := strings.SplitN(s, "=", 2)
+			if len(split) != 2 || split[0] == "" || split[1] == "" {
+				fatal(errors.New("invalid response, expected id=file: " + s))
+			}
+			data, err := ioutil.ReadFile(split[1])
+			if err != nil {
+				fatal(err)
+			}
+			err = handler.AddResponseJson(split[0], data)
+			if err != nil {
+				fatal(fmt.Errorf("invalid response in %s: %w", split[1], err))
+			}
+		}
+
+		faults := mockFaults
+		for _, s := range mockFaultRoutes {
+			route, err := parseMockRoute(s)
+			if err != nil {
+				fatal(err)
+			}
+			faults.Routes = append(faults.Routes, route)
+		}
+		handler.SetFaults(faults)
+
+		fmt.Fprintf(os.Stderr, "Serving mock EnvKey host at http://%s\n", mockAddr)
+		fatal(http.ListenAndServe(mockAddr, handler))
+	},
+}
+
+func parseMockRoute(s string) (envkeytest.Route, error) {
+	for _, route := range envkeytest.Routes {
+		if string(route) == s {
+			return route, nil
+		}
+	}
+	return "", errors.New("unknown route: " + s)
+}
+
+func init() {
+	serveMockCmd.Flags().StringVar(&mockAddr, "addr", "localhost:3000", "address to listen on")
+	serveMockCmd.Flags().StringSliceVar(&mockResponses, "response", nil, "id=file of a response to serve for envkeys starting with id, may be repeated")
+	serveMockCmd.Flags().DurationVar(&mockFaults.Latency, "latency", 0, "delay every response, e.g. 500ms")
+	serveMockCmd.Flags().IntVar(&mockFaults.ServerErrors, "server-errors", 0, "respond 503 to this many requests before recovering, or to every request if -1")
+	serveMockCmd.Flags().BoolVar(&mockFaults.NotFound, "not-found", false, "respond 404 as if every envkey were invalid")
+	serveMockCmd.Flags().BoolVar(&mockFaults.Truncate, "truncate", false, "cut off response bodies halfway")
+	serveMockCmd.Flags().BoolVar(&mockFaults.BadSignature, "bad-signature", false, "tamper with signed trusted keys so verification fails")
+	serveMockCmd.Flags().StringSliceVar(&mockFaultRoutes, "fault-routes", nil, "only inject faults on these routes: primary, backup, backup-restricted (default is all)")
+	RootCmd.AddCommand(serveMockCmd)
+}
@@ -21,10 +21,17 @@
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/envkey/envkey-fetch/fetch"
+	"github.com/envkey/envkey-fetch/output"
+	"github.com/envkey/envkey-fetch/parser"
+	"github.com/envkey/envkey-fetch/trust"
 	"github.com/envkey/envkey-fetch/version"
 
 	"github.com/spf13/cobra"
@@ -39,11 +46,40 @@ var clientVersion string
 var timeoutSeconds float64
 var retries uint8
 var retryBackoff float64
+var printMetadata bool
+var interpolate bool
+var interpolateProcessEnv bool
+var outputFormat string
+var outputFile string
+var outputDir string
+var manifestName string
+var manifestNamespace string
+var manifestLabels []string
+var configMapKeys []string
+var pins []string
+var pinFile string
+var explain bool
+var maxResponseBytes int64
+var strictDecode bool
+var apiVersion int
+var experimentalApiVersions bool
+var snapshotFile string
+var proxy string
+var noProxy string
+var caFile string
+var clientCertFile string
+var clientKeyFile string
+var tlsPins []string
+var tlsPinsReportOnly bool
+var snapshotMaxAge string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "envkey-fetch YOUR-ENVKEY",
 	Short: "Fetches, decrypts, and verifies EnvKey config. Accepts a single envkey as an argument. Returns decrypted config as json. Can optionally cache encrypted config locally.",
+	Args:  cobra.ArbitraryArgs,
+	// Don't add a completion subcommand alongside the envkey argument
+	CompletionOptions: cobra.CompletionOptions{DisableDefaultCmd: true},
 	Run: func(cmd *cobra.Command, args []string) {
 		if printVersion {
 			fmt.Println(version.Version)
@@ -51,13 +87,13 @@ var RootCmd = &cobra.Command{
 		}
 
 		if len(args) > 0 {
-			res, err := fetch.Fetch(args[0], fetch.FetchOptions{shouldCache, cacheDir, clientName, clientVersion, verboseOutput, timeoutSeconds, retries, retryBackoff})
+			options, err := fetchOptions()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "error: "+err.Error())
-				os.Exit(1)
-			} else {
-				fmt.Println(res)
+				fatal(err)
 			}
+
+			res, err := fetch.FetchWithMetadata(args[0], options)
+			printResult(res, err)
 		} else {
 			cmd.Help()
 		}
@@ -73,14 +109,217 @@ func Execute() {
 	}
 }
 
+func fetchOptions() (fetch.FetchOptions, error) {
+	var pinnedRoots trust.Pins
+	for _, s := range pins {
+		pin, err := trust.ParsePin(s)
+		if err != nil {
+			return fetch.FetchOptions{}, err
+		}
+		pinnedRoots = append(pinnedRoots, pin)
+	}
+
+	tlsPinnedKeys := make(fetch.TLSPins)
+	for _, s := range tlsPins {
+		host, pin, err := fetch.ParseTLSPin(s)
+		if err != nil {
+			return fetch.FetchOptions{}, err
+		}
+		tlsPinnedKeys.Add(host, pin)
+	}
+
+	var maxAge time.Duration
+	if snapshotMaxAge != "" {
+		var err error
+		maxAge, err = parseMaxAge(snapshotMaxAge)
+		if err != nil {
+			return fetch.FetchOptions{}, err
+		}
+	}
+
+	return fetch.FetchOptions{
+		ShouldCache:           shouldCache,
+		CacheDir:              cacheDir,
+		ClientName:            clientName,
+		ClientVersion:         clientVersion,
+		VerboseOutput:         verboseOutput,
+		TimeoutSeconds:        timeoutSeconds,
+		Retries:               retries,
+		RetryBackoff:          retryBackoff,
+		Interpolate:           interpolate || interpolateProcessEnv,
+		InterpolateProcessEnv: interpolateProcessEnv,
+		PinnedRoots:           pinnedRoots,
+		PinFile:               pinFile,
+		Explain:               explain,
+		MaxResponseBytes:      maxResponseBytes,
+		StrictDecode:          strictDecode,
+		ApiVersion:            apiVersion,
+		Snapshot:              snapshotFile,
+		SnapshotMaxAge:        maxAge,
+		Proxy:                 proxy,
+		NoProxy:               noProxy,
+		CAFile:                caFile,
+		ClientCertFile:        clientCertFile,
+		ClientKeyFile:         clientKeyFile,
+		TLSPins:               tlsPinnedKeys,
+		TLSPinsReportOnly:     tlsPinsReportOnly,
+	}, nil
+}
+
+// printResult writes a fetched or decrypted result, or exits with its error,
+// printing the trust chain explanations to stderr with --explain.
+func printResult(res *fetch.Result, err error) {
+	if err != nil {
+		var explainedErr *trust.ExplainedError
+		if errors.As(err, &explainedErr) {
+			fmt.Fprint(os.Stderr, explainedErr.Explanation)
+		}
+		fatal(err)
+	}
+
+	if explain {
+		for _, explanation := range res.Metadata.TrustChain {
+			fmt.Fprint(os.Stderr, explanation)
+		}
+	}
+
+	err = writeOutput(res)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func outputOptions() (output.Options, error) {
+	labels := make(map[string]string)
+	for _, label := range manifestLabels {
+		split := strings.SplitN(label, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return output.Options{}, errors.New("invalid label, expected key=value: " + label)
+		}
+		labels[split[0]] = split[1]
+	}
+
+	return output.Options{
+		Name:          manifestName,
+		Namespace:     manifestNamespace,
+		Labels:        labels,
+		ConfigMapKeys: configMapKeys,
+	}, nil
+}
+
+func writeOutput(res *fetch.Result) error {
+	options, err := outputOptions()
+	if err != nil {
+		return err
+	}
+
+	if printMetadata {
+		if outputFormat != output.FormatJson {
+			return errors.New("--metadata can only be used with json output")
+		} else if outputDir != "" {
+			return errors.New("--metadata can't be used with --output-dir")
+		}
+		envelope, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		if outputFile != "" {
+			return output.WriteAtomic(outputFile, append(envelope, '\n'))
+		}
+		fmt.Println(string(envelope))
+		return nil
+	}
+
+	if outputFile != "" || outputDir != "" {
+		values, err := res.Config()
+		if err != nil {
+			return err
+		}
+
+		if outputFile != "" {
+			err = output.WriteFile(outputFile, values, outputFormat, options)
+			if err != nil {
+				return err
+			}
+		}
+
+		if outputDir != "" {
+			err = output.WriteDir(outputDir, values)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if outputFormat == output.FormatJson {
+		fmt.Println(res.Env)
+		return nil
+	}
+
+	values, err := res.Config()
+	if err != nil {
+		return err
+	}
+	rendered, err := output.Render(values, outputFormat, options)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(rendered))
+	return nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "error: "+err.Error())
+	os.Exit(1)
+}
+
 func init() {
-	RootCmd.Flags().BoolVar(&shouldCache, "cache", false, "cache encrypted config as a local backup (default is false)")
-	RootCmd.Flags().StringVar(&cacheDir, "cache-dir", "", "cache directory (default is $HOME/.envkey/cache)")
-	RootCmd.Flags().StringVar(&clientName, "client-name", "", "calling client library name (default is none)")
-	RootCmd.Flags().StringVar(&clientVersion, "client-version", "", "calling client library version (default is none)")
+	cobra.OnInitialize(func() {
+		if experimentalApiVersions {
+			parser.EnableExperimentalApiVersions()
+		}
+	})
+
+	RootCmd.PersistentFlags().BoolVar(&shouldCache, "cache", false, "cache encrypted config as a local backup (default is false)")
+	RootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "cache directory (default is $HOME/.envkey/cache)")
+	RootCmd.PersistentFlags().StringVar(&clientName, "client-name", "", "calling client library name (default is none)")
+	RootCmd.PersistentFlags().StringVar(&clientVersion, "client-version", "", "calling client library version (default is none)")
 	RootCmd.Flags().BoolVarP(&printVersion, "version", "v", false, "prints the version")
-	RootCmd.Flags().BoolVar(&verboseOutput, "verbose", false, "print verbose output (default is false)")
-	RootCmd.Flags().Float64Var(&timeoutSeconds, "timeout", 20.0, "timeout in seconds for http requests")
-	RootCmd.Flags().Uint8Var(&retries, "retries", 3, "number of times to retry requests on failure")
-	RootCmd.Flags().Float64Var(&retryBackoff, "retryBackoff", 1, "retry backoff factor: {retryBackoff} * (2 ^ {retries - 1})")
+	RootCmd.PersistentFlags().BoolVar(&verboseOutput, "verbose", false, "print verbose output (default is false)")
+	RootCmd.PersistentFlags().Float64Var(&timeoutSeconds, "timeout", 20.0, "timeout in seconds for http requests")
+	RootCmd.PersistentFlags().Uint8Var(&retries, "retries", 3, "number of times to retry requests on failure")
+	RootCmd.PersistentFlags().Float64Var(&retryBackoff, "retryBackoff", 1, "retry backoff factor: {retryBackoff} * (2 ^ {retries - 1})")
+	RootCmd.PersistentFlags().Int64Var(&maxResponseBytes, "max-response-size", fetch.DefaultMaxResponseBytes, "maximum size in bytes of a served or cached response")
+	RootCmd.PersistentFlags().BoolVar(&strictDecode, "strict", false, "reject responses with unknown fields (default is false)")
+	RootCmd.PersistentFlags().IntVar(&apiVersion, "api-version", fetch.ApiVersion, "api version to request from the EnvKey host")
+	RootCmd.PersistentFlags().BoolVar(&experimentalApiVersions, "experimental-api-versions", false, "decode and advertise draft api versions the EnvKey host doesn't serve yet, like v2, e.g. for testing with serve-mock (default is false)")
+	RootCmd.PersistentFlags().StringSliceVar(&pins, "pin", nil, "id=fingerprint of a root signer the trust chain must end at, may be repeated")
+	RootCmd.PersistentFlags().StringVar(&pinFile, "pin-file", "", "json file mapping envkey ids to the root signers the trust chain must end at")
+	RootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "http, https or socks5 proxy url for requests (default is $HTTPS_PROXY or $HTTP_PROXY)")
+	RootCmd.PersistentFlags().StringVar(&noProxy, "no-proxy", "", "comma-separated hosts, ip addresses and CIDR ranges to connect to without --proxy (default is $NO_PROXY)")
+	RootCmd.PersistentFlags().StringVar(&caFile, "ca-file", "", "PEM file of CA certificates to trust in addition to the system roots")
+	RootCmd.PersistentFlags().StringVar(&clientCertFile, "client-cert", "", "PEM client certificate for mutual TLS, with --client-key")
+	RootCmd.PersistentFlags().StringVar(&clientKeyFile, "client-key", "", "PEM client key for mutual TLS, with --client-cert")
+	RootCmd.PersistentFlags().StringSliceVar(&tlsPins, "tls-pin", nil, "host=sha256/BASE64 public key pin a host's certificate chain must include, may be repeated")
+	RootCmd.PersistentFlags().BoolVar(&tlsPinsReportOnly, "tls-pin-report-only", false, "log TLS pin mismatches to stderr instead of refusing the connection (default is false)")
+	RootCmd.Flags().StringVar(&snapshotFile, "snapshot", "", "decrypt and verify a snapshot file instead of fetching")
+	RootCmd.Flags().StringVar(&snapshotMaxAge, "snapshot-max-age", "", "refuse snapshots fetched longer ago than this, in days like 30d or a duration like 12h (default is no limit)")
+	addOutputFlags(RootCmd)
+}
+
+// addOutputFlags adds the flags for decrypting and writing config to cmd.
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&interpolate, "interpolate", false, "expand ${VAR} and ${VAR:-default} references between config values (default is false)")
+	cmd.Flags().BoolVar(&interpolateProcessEnv, "interpolate-env", false, "like --interpolate, but also expand references from the process environment (default is false)")
+	cmd.Flags().StringVar(&outputFormat, "format", output.FormatJson, "output format: "+strings.Join(output.Formats, ", "))
+	cmd.Flags().StringVar(&outputFile, "output-file", "", "atomically write config to a file with 0600 permissions instead of stdout")
+	cmd.Flags().StringVar(&outputDir, "output-dir", "", "write each config key to its own file in a directory instead of stdout, removing keys that no longer exist")
+	cmd.Flags().StringVar(&manifestName, "name", "", "name of the generated Secret or ConfigMap (k8s formats only)")
+	cmd.Flags().StringVar(&manifestNamespace, "namespace", "", "namespace of the generated Secret or ConfigMap (k8s formats only)")
+	cmd.Flags().StringArrayVar(&manifestLabels, "label", nil, "key=value label for the generated Secret or ConfigMap, may be repeated (k8s formats only)")
+	cmd.Flags().StringSliceVar(&configMapKeys, "configmap-keys", nil, "comma-separated allowlist of non-secret keys to include (k8s-configmap format only)")
+	cmd.Flags().BoolVar(&explain, "explain", false, "print the trust chain walked for each signer to stderr, including where it broke on failure (default is false)")
+	cmd.Flags().BoolVar(&printMetadata, "metadata", false, "wrap output in a json envelope with fetch metadata (default is false)")
 }
@@ -0,0 +1,81 @@
+// Copyright © 2017 Envkey Inc. <support@envkey.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envkey/envkey-fetch/fetch"
+
+	"github.com/spf13/cobra"
+)
+
+var snapshotOut string
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot YOUR-ENVKEY",
+	Short: "Fetches and verifies encrypted config and saves it, still encrypted, as a snapshot file that can be decrypted later with --snapshot, e.g. when building images for air-gapped deploys.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		options, err := fetchOptions()
+		if err != nil {
+			fatal(err)
+		}
+
+		snapshot, err := fetch.FetchSnapshot(args[0], options)
+		if err != nil {
+			fatal(err)
+		}
+
+		err = snapshot.WriteFile(snapshotOut)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote snapshot fetched at %s to %s\n", snapshot.FetchedAt.Format(time.RFC3339), snapshotOut)
+	},
+}
+
+// parseMaxAge parses a number of days like 30d, or a duration like 12h.
+func parseMaxAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, errors.New("invalid max age: " + s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	maxAge, err := time.ParseDuration(s)
+	if err != nil || maxAge <= 0 {
+		return 0, errors.New("invalid max age: " + s)
+	}
+	return maxAge, nil
+}
+
+func init() {
+	snapshotCmd.Flags().StringVarP(&snapshotOut, "output", "o", "", "file to write the snapshot to")
+	snapshotCmd.MarkFlagRequired("output")
+	RootCmd.AddCommand(snapshotCmd)
+}
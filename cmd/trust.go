@@ -0,0 +1,81 @@
+// Copyright © 2017 Envkey Inc. <support@envkey.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/envkey/envkey-fetch/fetch"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	graphFormatDot  = "dot"
+	graphFormatJson = "json"
+)
+
+var graphFormat string
+
+var trustCmd = &cobra.Command{
+	Use:   "trust",
+	Short: "Inspects the web of trust that signs an ENVKEY's config.",
+}
+
+var trustGraphCmd = &cobra.Command{
+	Use:   "graph YOUR-ENVKEY",
+	Short: "Fetches and verifies the trusted keys for an ENVKEY and prints their invite graph as Graphviz DOT or json, without decrypting config.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if graphFormat != graphFormatDot && graphFormat != graphFormatJson {
+			fatal(errors.New("unknown graph format: " + graphFormat))
+		}
+
+		options, err := fetchOptions()
+		if err != nil {
+			fatal(err)
+		}
+
+		graph, err := fetch.FetchTrustGraph(args[0], options)
+		if err != nil {
+			fatal(err)
+		}
+
+		if graphFormat == graphFormatJson {
+			graphJson, err := json.Marshal(graph)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Println(string(graphJson))
+			return
+		}
+
+		fmt.Print(graph.DOT())
+	},
+}
+
+func init() {
+	trustGraphCmd.Flags().StringVar(&graphFormat, "format", graphFormatDot, "graph format: dot, json")
+	trustCmd.AddCommand(trustGraphCmd)
+	RootCmd.AddCommand(trustCmd)
+}
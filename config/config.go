@@ -0,0 +1,375 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+type Config struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+type MissingKeyError struct {
+	Key string
+}
+
+func (err *MissingKeyError) Error() string {
+	return "Missing config key: " + err.Key
+}
+
+type InvalidValueError struct {
+	Key   string
+	Value string
+	Type  string
+	Err   error
+}
+
+func (err *InvalidValueError) Error() string {
+	return fmt.Sprintf("Invalid %s value for config key %s: %q (%s)", err.Type, err.Key, err.Value, err.Err.Error())
+}
+
+// New returns a config with keys in sorted order.
+func New(values map[string]interface{}) *Config {
+	return NewOrdered(nil, values)
+}
+
+// NewOrdered returns a config with keys in the given order. Any keys of values
+// that aren't listed follow in sorted order.
+func NewOrdered(keys []string, values map[string]interface{}) *Config {
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+
+	ordered := make([]string, 0, len(values))
+	listed := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if _, ok := values[k]; ok && !listed[k] {
+			ordered = append(ordered, k)
+			listed[k] = true
+		}
+	}
+
+	var rest []string
+	for k := range values {
+		if !listed[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+
+	return &Config{append(ordered, rest...), values}
+}
+
+// Keys returns the keys with non-null values, in order.
+func (config *Config) Keys() []string {
+	keys := make([]string, 0, len(config.keys))
+	for _, k := range config.keys {
+		if config.values[k] != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// MarshalJSON writes every value, including nulls, as a json object in key
+// order.
+func (config *Config) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range config.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(config.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (config *Config) Map() map[string]string {
+	res := make(map[string]string, len(config.values))
+	for _, k := range config.Keys() {
+		res[k], _ = config.Get(k)
+	}
+	return res
+}
+
+func (config *Config) Has(key string) bool {
+	v, ok := config.values[key]
+	return ok && v != nil
+}
+
+func (config *Config) Get(key string) (string, bool) {
+	v, ok := config.values[key]
+	if !ok || v == nil {
+		return "", false
+	}
+
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(val), true
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Sprint(val), true
+		}
+		return string(b), true
+	default:
+		return fmt.Sprint(val), true
+	}
+}
+
+func (config *Config) MustGet(key string) string {
+	v, ok := config.Get(key)
+	if !ok {
+		panic(&MissingKeyError{key})
+	}
+	return v
+}
+
+func (config *Config) Int(key string) (int, error) {
+	s, err := config.required(key)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, &InvalidValueError{key, s, "int", err}
+	}
+	return i, nil
+}
+
+func (config *Config) Bool(key string) (bool, error) {
+	s, err := config.required(key)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return false, &InvalidValueError{key, s, "bool", err}
+	}
+	return b, nil
+}
+
+func (config *Config) Duration(key string) (time.Duration, error) {
+	s, err := config.required(key)
+	if err != nil {
+		return 0, err
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return 0, &InvalidValueError{key, s, "duration", err}
+	}
+	return d, nil
+}
+
+func (config *Config) URL(key string) (*url.URL, error) {
+	s, err := config.required(key)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, &InvalidValueError{key, s, "url", err}
+	}
+	return u, nil
+}
+
+// Decode binds config values into the fields of the struct pointed to by v.
+// Fields are matched with `env:"NAME,required,default=VALUE"` tags. Untagged
+// struct fields are decoded recursively; other untagged fields are ignored.
+func (config *Config) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("Decode requires a non-nil pointer to a struct.")
+	}
+	return config.decodeStruct(rv.Elem())
+}
+
+func (config *Config) required(key string) (string, error) {
+	s, ok := config.Get(key)
+	if !ok {
+		return "", &MissingKeyError{key}
+	}
+	return s, nil
+}
+
+type fieldTag struct {
+	name       string
+	required   bool
+	hasDefault bool
+	defaultVal string
+}
+
+func parseFieldTag(tag string) fieldTag {
+	var res fieldTag
+	parts := strings.Split(tag, ",")
+	res.name = strings.TrimSpace(parts[0])
+
+	for i := 1; i < len(parts); i++ {
+		opt := strings.TrimSpace(parts[i])
+		if opt == "required" {
+			res.required = true
+		} else if strings.HasPrefix(opt, "default=") {
+			// default is always the last option so that it may contain commas
+			res.hasDefault = true
+			res.defaultVal = strings.TrimPrefix(strings.Join(parts[i:], ","), "default=")
+			break
+		}
+	}
+
+	return res
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var urlType = reflect.TypeOf(url.URL{})
+var stringSliceType = reflect.TypeOf([]string(nil))
+
+func (config *Config) decodeStruct(rv reflect.Value) error {
+	var err error
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		fieldVal := rv.Field(i)
+		if !fieldVal.CanSet() {
+			continue
+		}
+
+		tag, ok := field.Tag.Lookup("env")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct && field.Type != urlType {
+				if decodeErr := config.decodeStruct(fieldVal); decodeErr != nil {
+					err = multierror.Append(err, decodeErr)
+				}
+			}
+			continue
+		}
+
+		if tag == "-" {
+			continue
+		}
+
+		parsed := parseFieldTag(tag)
+		if parsed.name == "" {
+			parsed.name = field.Name
+		}
+
+		s, ok := config.Get(parsed.name)
+		if !ok {
+			if parsed.hasDefault {
+				s = parsed.defaultVal
+			} else if parsed.required {
+				err = multierror.Append(err, &MissingKeyError{parsed.name})
+				continue
+			} else {
+				continue
+			}
+		}
+
+		if setErr := setField(fieldVal, s); setErr != nil {
+			err = multierror.Append(err, &InvalidValueError{parsed.name, s, field.Type.String(), setErr})
+		}
+	}
+
+	return err
+}
+
+func setField(fieldVal reflect.Value, s string) error {
+	if fieldVal.Kind() == reflect.Ptr {
+		ptr := reflect.New(fieldVal.Type().Elem())
+		if err := setField(ptr.Elem(), s); err != nil {
+			return err
+		}
+		fieldVal.Set(ptr)
+		return nil
+	}
+
+	switch fieldVal.Type() {
+	case durationType:
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		fieldVal.SetInt(int64(d))
+		return nil
+	case urlType:
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		fieldVal.Set(reflect.ValueOf(*u))
+		return nil
+	}
+
+	switch fieldVal.Kind() {
+	case reflect.String:
+		fieldVal.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		fieldVal.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, fieldVal.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fieldVal.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(strings.TrimSpace(s), 10, fieldVal.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fieldVal.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), fieldVal.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fieldVal.SetFloat(f)
+	case reflect.Slice:
+		if fieldVal.Type() != stringSliceType {
+			return errors.New("unsupported slice type")
+		}
+		var items []string
+		if s != "" {
+			for _, item := range strings.Split(s, ",") {
+				items = append(items, strings.TrimSpace(item))
+			}
+		}
+		fieldVal.Set(reflect.ValueOf(items))
+	default:
+		return errors.New("unsupported field type")
+	}
+
+	return nil
+}
@@ -5,72 +5,252 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"reflect"
+	"sort"
+	"time"
 
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
+var ErrWrongPassphrase = errors.New("Wrong passphrase.")
+
+var ErrMalformed = errors.New("Malformed OpenPGP data.")
+
+var ErrKeyExpired = errors.New("Key expired.")
+var ErrKeyRevoked = errors.New("Key revoked.")
+var ErrKeyNotYetValid = errors.New("Key created in the future.")
+var ErrSignatureExpired = errors.New("Signature expired.")
+var ErrSignatureNotYetValid = errors.New("Signature created in the future.")
+var ErrCertificationRevoked = errors.New("Certification revoked.")
+
+// recoverMalformed turns a panic while parsing untrusted OpenPGP data into
+// ErrMalformed. The openpgp packages can panic on some malformed packets
+// rather than returning an error, so every entry point that parses input from
+// the network defers this.
+func recoverMalformed(err *error) {
+	if recover() != nil {
+		*err = ErrMalformed
+	}
+}
+
 func ReadPrivkey(encryptedPrivkeyArmored, pw []byte) (openpgp.EntityList, error) {
 	// Read the private key
 	entityList, err := ReadArmoredKey(encryptedPrivkeyArmored)
 	if err != nil {
 		return nil, err
 	}
-	entity := entityList[0]
 
-	// Get the passphrase and read the private key.
-	entity.PrivateKey.Decrypt(pw)
+	// Unlock every private key in the keyring with the passphrase
+	var privkeys openpgp.EntityList
+	for _, entity := range entityList {
+		if entity.PrivateKey == nil {
+			continue
+		}
+
+		err = unlockEntity(entity, pw)
+		if err != nil {
+			return nil, err
+		}
+		privkeys = append(privkeys, entity)
+	}
+
+	if len(privkeys) == 0 {
+		return nil, errors.New("No private key found.")
+	}
+
+	return privkeys, nil
+}
+
+func unlockEntity(entity *openpgp.Entity, pw []byte) error {
+	err := unlockPrivateKey(entity.PrivateKey, pw)
+	if err != nil {
+		return err
+	}
+
 	for _, subkey := range entity.Subkeys {
-		subkey.PrivateKey.Decrypt(pw)
+		err = unlockPrivateKey(subkey.PrivateKey, pw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unlockPrivateKey(privkey *packet.PrivateKey, pw []byte) error {
+	// Public-only subkeys and keys that aren't encrypted need no unlocking
+	if privkey == nil || !privkey.Encrypted {
+		return nil
+	}
+
+	if privkey.Decrypt(pw) != nil {
+		return ErrWrongPassphrase
 	}
 
-	return entityList, nil
+	return nil
 }
 
-func ReadArmoredKey(armoredKey []byte) (openpgp.EntityList, error) {
+func ReadArmoredKey(armoredKey []byte) (entityList openpgp.EntityList, err error) {
+	defer recoverMalformed(&err)
 	keyringFileBuffer := bytes.NewBuffer(armoredKey)
 	return openpgp.ReadArmoredKeyRing(keyringFileBuffer)
 }
 
+// VerifyKeyValid checks that the primary key of every entity in keys is usable
+// at now: created no later than now, not expired according to its primary
+// self-signature, and neither the key nor its primary identity revoked.
+func VerifyKeyValid(keys openpgp.EntityList, now time.Time) error {
+	if len(keys) == 0 {
+		return errors.New("No key found.")
+	}
+
+	for _, entity := range keys {
+		if entity.PrimaryKey == nil {
+			return errors.New("Public key is missing a primary key.")
+		}
+
+		if entity.PrimaryKey.CreationTime.After(now) {
+			return ErrKeyNotYetValid
+		}
+
+		if entity.Revoked(now) {
+			return ErrKeyRevoked
+		}
+
+		selfSignature, primaryIdentity := entity.PrimarySelfSignature()
+		if primaryIdentity != nil && primaryIdentity.Revoked(now) {
+			return ErrKeyRevoked
+		}
+
+		if entity.PrimaryKey.KeyExpired(selfSignature, now) {
+			return ErrKeyExpired
+		}
+	}
+
+	return nil
+}
+
 func MakeKeyring(decryptedPrivkey openpgp.EntityList, pubkeyArmored []byte) (openpgp.EntityList, error) {
 	pubkey, err := ReadArmoredKey(pubkeyArmored)
 	if err != nil {
 		return nil, err
 	}
-	return append(decryptedPrivkey, pubkey...), nil
+	// A fresh slice, so keyrings made from the same private keys don't share
+	// a backing array
+	keyring := append(openpgp.EntityList{}, decryptedPrivkey...)
+	return append(keyring, pubkey...), nil
 }
 
+// MatchingPrivkey returns the decrypted private key whose fingerprint matches
+// pubkey, out of a keyring of any number of private keys.
+func MatchingPrivkey(pubkey, decryptedPrivkey openpgp.EntityList) (*openpgp.Entity, error) {
+	if len(pubkey) != 1 {
+		return nil, errors.New("Requires a single public key.")
+	}
+	for _, entity := range decryptedPrivkey {
+		if entity.PrivateKey != nil && bytes.Equal(entity.PrimaryKey.Fingerprint, pubkey[0].PrimaryKey.Fingerprint) {
+			return entity, nil
+		}
+	}
+	return nil, errors.New("Pubkey fingerprint does not match private key fingerprint.")
+}
+
+// VerifyPubkeyWithPrivkey checks that pubkey is the public half of one of the
+// decrypted private keys by comparing fingerprints and key material of the
+// primary key and every subkey. Private key material is validated against its
+// public half when the key is parsed, so no public-key operation is needed.
 func VerifyPubkeyWithPrivkey(pubkey, decryptedPrivkey openpgp.EntityList) error {
-	var encrypted, decrypted []byte
-	var err error
+	_, err := VerifiedPrivkey(pubkey, decryptedPrivkey)
+	return err
+}
 
-	msg := []byte("test message")
+// VerifiedPrivkey is VerifyPubkeyWithPrivkey, returning the private key that
+// pubkey is the public half of.
+func VerifiedPrivkey(pubkey, decryptedPrivkey openpgp.EntityList) (*openpgp.Entity, error) {
+	priv, err := MatchingPrivkey(pubkey, decryptedPrivkey)
+	if err != nil {
+		return nil, err
+	}
+	pub := pubkey[0]
 
-	encrypted, err = Encrypt(msg, pubkey)
+	if priv.PrivateKey.Encrypted {
+		return nil, errors.New("Private key is not decrypted.")
+	}
+
+	err = verifyKeyMaterial(pub.PrimaryKey, &priv.PrivateKey.PublicKey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if len(pub.Subkeys) != len(priv.Subkeys) {
+		return nil, errors.New("Pubkey subkeys do not match private key subkeys.")
+	}
+
+	for _, pubSubkey := range pub.Subkeys {
+		var privSubkey *openpgp.Subkey
+		for i := range priv.Subkeys {
+			if bytes.Equal(priv.Subkeys[i].PublicKey.Fingerprint, pubSubkey.PublicKey.Fingerprint) {
+				privSubkey = &priv.Subkeys[i]
+				break
+			}
+		}
+		if privSubkey == nil {
+			return nil, errors.New("Pubkey subkey fingerprint does not match any private key subkey.")
+		}
+
+		privSubkeyPub := privSubkey.PublicKey
+		if privSubkey.PrivateKey != nil {
+			if privSubkey.PrivateKey.Encrypted {
+				return nil, errors.New("Private subkey is not decrypted.")
+			}
+			privSubkeyPub = &privSubkey.PrivateKey.PublicKey
+		}
+
+		err = verifyKeyMaterial(pubSubkey.PublicKey, privSubkeyPub)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	decrypted, err = Decrypt(encrypted, decryptedPrivkey)
+	return priv, nil
+}
+
+func verifyKeyMaterial(pubkey, privkeyPublic *packet.PublicKey) error {
+	if !bytes.Equal(pubkey.Fingerprint, privkeyPublic.Fingerprint) {
+		return errors.New("Pubkey fingerprint does not match private key fingerprint.")
+	}
+
+	var pubBuf, privBuf bytes.Buffer
+	err := pubkey.Serialize(&pubBuf)
+	if err != nil {
+		return err
+	}
+	err = privkeyPublic.Serialize(&privBuf)
 	if err != nil {
 		return err
 	}
 
-	if bytes.Equal(msg, decrypted) {
-		return nil
-	} else {
-		return errors.New("Decrypted message does not match original message.")
+	if !bytes.Equal(pubBuf.Bytes(), privBuf.Bytes()) {
+		return errors.New("Pubkey material does not match private key.")
 	}
+
+	return nil
 }
 
 func Encrypt(msg []byte, pubkeys openpgp.EntityList) ([]byte, error) {
+	return EncryptAndSign(msg, pubkeys, nil)
+}
+
+// EncryptAndSign encrypts msg to pubkeys and, if signer isn't nil, signs it
+// with signer's decrypted private key.
+func EncryptAndSign(msg []byte, pubkeys openpgp.EntityList, signer *openpgp.Entity) ([]byte, error) {
 	var encCloser, armorCloser io.WriteCloser
 	var err error
 
 	encbuf := new(bytes.Buffer)
-	encCloser, err = openpgp.Encrypt(encbuf, pubkeys, nil, nil, nil)
+	encCloser, err = openpgp.Encrypt(encbuf, pubkeys, signer, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -105,24 +285,76 @@ func Decrypt(cipherArmored []byte, keys openpgp.EntityList) ([]byte, error) {
 	if !(len(keys) == 1 && keys[0].PrivateKey != nil) {
 		return nil, errors.New("Requires a single private key.")
 	}
-	return readMessage(cipherArmored, keys)
+	return readMessage(cipherArmored, keys, nil, time.Now())
 }
 
 func DecryptAndVerify(cipherArmored []byte, keys openpgp.EntityList) ([]byte, error) {
-	if !(len(keys) == 2 && keys[0].PrivateKey != nil && keys[1].PrivateKey == nil) {
-		return nil, errors.New("Requires a single private key and a single public key.")
+	return DecryptAndVerifyAt(cipherArmored, keys, time.Now())
+}
+
+// DecryptAndVerifyAt is DecryptAndVerify with signature and signing key
+// validity evaluated at now rather than the current time. keys are any number
+// of private keys to decrypt with and the single public key of the signer, in
+// any order.
+func DecryptAndVerifyAt(cipherArmored []byte, keys openpgp.EntityList, now time.Time) ([]byte, error) {
+	var privkeys int
+	var pubkeys openpgp.EntityList
+	for _, key := range keys {
+		if key.PrivateKey != nil {
+			privkeys++
+		} else {
+			pubkeys = append(pubkeys, key)
+		}
+	}
+	if privkeys == 0 || len(pubkeys) != 1 {
+		return nil, errors.New("Requires a private key and a single public key.")
+	}
+
+	return readMessage(cipherArmored, keys, pubkeys[0], now)
+}
+
+// SignCleartext clearsigns message with signer's decrypted private key.
+func SignCleartext(message []byte, signer *openpgp.Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return readMessage(cipherArmored, keys)
+	_, err = w.Write(message)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
 func VerifySignedCleartext(message []byte, keys openpgp.EntityList) ([]byte, error) {
+	return VerifySignedCleartextAt(message, keys, time.Now())
+}
+
+// VerifySignedCleartextAt is VerifySignedCleartext with signature and signing
+// key validity evaluated at now rather than the current time.
+func VerifySignedCleartextAt(message []byte, keys openpgp.EntityList, now time.Time) (verified []byte, err error) {
+	defer recoverMalformed(&err)
+
 	if !(len(keys) == 1 && keys[0].PrivateKey == nil) {
 		return nil, errors.New("Requires a single public key.")
 	}
 
 	block, _ := clearsign.Decode(message)
-	_, err := openpgp.CheckDetachedSignature(keys, bytes.NewBuffer(block.Bytes), block.ArmoredSignature.Body)
+	if block == nil {
+		return nil, errors.New("Message is not clearsigned.")
+	} else if block.ArmoredSignature == nil {
+		return nil, errors.New("Clearsigned message has no signature.")
+	}
+
+	_, err = openpgp.CheckDetachedSignature(keys, bytes.NewBuffer(block.Bytes), block.ArmoredSignature.Body, configAt(now))
 
 	if err != nil {
 		return nil, err
@@ -132,16 +364,170 @@ func VerifySignedCleartext(message []byte, keys openpgp.EntityList) ([]byte, err
 }
 
 func VerifyPubkeySignature(signedPubkey, signerPubkey openpgp.EntityList) error {
+	return VerifyPubkeySignatureAt(signedPubkey, signerPubkey, time.Now())
+}
+
+// VerifyPubkeySignatureAt checks that signedPubkey has a certification issued
+// by signerPubkey that is valid at now, and that the signer's key is itself
+// valid at now. Identities are checked in sorted order and every certification
+// by the signer is tried until one verifies.
+func VerifyPubkeySignatureAt(signedPubkey, signerPubkey openpgp.EntityList, now time.Time) error {
+	_, err := verifyPubkeySignature(signedPubkey, signerPubkey, now)
+	return err
+}
+
+// VerifyPubkeySignatureUntil is VerifyPubkeySignatureAt, also returning the
+// time until which the verification holds as long as neither key changes: the
+// earliest of the certification's expiry, the signer key's expiry and any
+// revocation dated after now. A zero time means it holds indefinitely.
+func VerifyPubkeySignatureUntil(signedPubkey, signerPubkey openpgp.EntityList, now time.Time) (time.Time, error) {
+	var validUntil time.Time
+
+	sig, err := verifyPubkeySignature(signedPubkey, signerPubkey, now)
+	if err != nil {
+		return validUntil, err
+	}
+
+	earliest := func(t time.Time) {
+		if validUntil.IsZero() || t.Before(validUntil) {
+			validUntil = t
+		}
+	}
+
+	if sig.SigLifetimeSecs != nil && *sig.SigLifetimeSecs != 0 {
+		earliest(sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second))
+	}
+
+	signerKey := signerPubkey[0]
+	selfSignature, _ := signerKey.PrimarySelfSignature()
+	if selfSignature != nil && selfSignature.KeyLifetimeSecs != nil && *selfSignature.KeyLifetimeSecs != 0 {
+		earliest(signerKey.PrimaryKey.CreationTime.Add(time.Duration(*selfSignature.KeyLifetimeSecs) * time.Second))
+	}
+
+	for _, entity := range []*openpgp.Entity{signedPubkey[0], signerKey} {
+		revocations := append([]*packet.Signature{}, entity.Revocations...)
+		for _, identity := range entity.Identities {
+			revocations = append(revocations, identity.Revocations...)
+			for _, identitySig := range identity.Signatures {
+				if identitySig != nil && identitySig.SigType == packet.SigTypeCertificationRevocation {
+					revocations = append(revocations, identitySig)
+				}
+			}
+		}
+		for _, revocation := range revocations {
+			if revocation != nil && revocation.CreationTime.After(now) {
+				earliest(revocation.CreationTime)
+			}
+		}
+	}
+
+	return validUntil, nil
+}
+
+// verifyPubkeySignature returns the certification that verified.
+func verifyPubkeySignature(signedPubkey, signerPubkey openpgp.EntityList, now time.Time) (sig *packet.Signature, err error) {
+	defer recoverMalformed(&err)
+
+	if len(signedPubkey) != 1 || len(signerPubkey) != 1 {
+		return nil, errors.New("Requires a single signed public key and a single signer public key.")
+	}
+
 	signedKey := signedPubkey[0]
 	signerKey := signerPubkey[0]
+	if signedKey.PrimaryKey == nil || signerKey.PrimaryKey == nil {
+		return nil, errors.New("Public key is missing a primary key.")
+	} else if bytes.Equal(signedKey.PrimaryKey.Fingerprint, signerKey.PrimaryKey.Fingerprint) {
+		return nil, errors.New("Public key can't certify itself.")
+	}
+
+	err = VerifyKeyValid(signerPubkey, now)
+	if err != nil {
+		return nil, err
+	}
+
+	identityNames := make([]string, 0, len(signedKey.Identities))
+	for name := range signedKey.Identities {
+		identityNames = append(identityNames, name)
+	}
+	if len(identityNames) == 0 {
+		return nil, errors.New("Signed public key has no identities.")
+	}
+	sort.Strings(identityNames)
+
+	for _, name := range identityNames {
+		identity := signedKey.Identities[name]
+		if identity == nil || identity.Revoked(now) {
+			continue
+		}
+
+		if certificationRevoked(name, identity, signedKey.PrimaryKey, signerKey.PrimaryKey, now) {
+			err = ErrCertificationRevoked
+			continue
+		}
+
+		// Identity signatures include self-signatures, so only try certifications
+		// issued by the signer
+		for _, sig = range identity.Signatures {
+			if sig == nil || !isCertification(sig) || !issuedBy(sig, signerKey.PrimaryKey) {
+				continue
+			}
+
+			err = signerKey.PrimaryKey.VerifyUserIdSignature(name, signedKey.PrimaryKey, sig)
+			if err != nil {
+				continue
+			}
+
+			if sig.CreationTime.After(now) {
+				err = ErrSignatureNotYetValid
+			} else if sig.SigExpired(now) {
+				err = ErrSignatureExpired
+			} else {
+				return sig, nil
+			}
+		}
+	}
+
+	if err == nil {
+		err = errors.New("No signature by signer found.")
+	}
+	return nil, err
+}
+
+// certificationRevoked checks for a certification revocation by the signer
+// over the identity that was issued no later than now.
+func certificationRevoked(name string, identity *openpgp.Identity, signed, signer *packet.PublicKey, now time.Time) bool {
+	for _, sig := range identity.Signatures {
+		if sig == nil || sig.SigType != packet.SigTypeCertificationRevocation || !issuedBy(sig, signer) {
+			continue
+		}
+
+		if !sig.CreationTime.After(now) && signer.VerifyUserIdSignature(name, signed, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
 
-	signedIdentityName := reflect.ValueOf(signedKey.Identities).MapKeys()[0].Interface().(string)
-	signature := signedKey.Identities[signedIdentityName].Signatures[0]
+func isCertification(sig *packet.Signature) bool {
+	switch sig.SigType {
+	case packet.SigTypeGenericCert, packet.SigTypePersonaCert, packet.SigTypeCasualCert, packet.SigTypePositiveCert:
+		return true
+	}
+	return false
+}
 
-	return signerKey.PrimaryKey.VerifyUserIdSignature(signedIdentityName, signedKey.PrimaryKey, signature)
+func issuedBy(sig *packet.Signature, signer *packet.PublicKey) bool {
+	if sig.IssuerFingerprint != nil {
+		return bytes.Equal(sig.IssuerFingerprint, signer.Fingerprint)
+	}
+	return sig.IssuerKeyId != nil && *sig.IssuerKeyId == signer.KeyId
 }
 
 func VerifyPubkeyArmoredSignature(signedPubkeyArmored, signerPubkeyArmored []byte) error {
+	return VerifyPubkeyArmoredSignatureAt(signedPubkeyArmored, signerPubkeyArmored, time.Now())
+}
+
+func VerifyPubkeyArmoredSignatureAt(signedPubkeyArmored, signerPubkeyArmored []byte, now time.Time) error {
 	signedPubkey, err := ReadArmoredKey(signedPubkeyArmored)
 	if err != nil {
 		return err
@@ -152,10 +538,34 @@ func VerifyPubkeyArmoredSignature(signedPubkeyArmored, signerPubkeyArmored []byt
 		return err
 	}
 
-	return VerifyPubkeySignature(signedPubkey, signerPubkey)
+	return VerifyPubkeySignatureAt(signedPubkey, signerPubkey, now)
 }
 
-func readMessage(armoredMessage []byte, keys openpgp.EntityList) ([]byte, error) {
+// VerifyPubkeyArmoredSignatureUntil is VerifyPubkeySignatureUntil for armored
+// keys.
+func VerifyPubkeyArmoredSignatureUntil(signedPubkeyArmored, signerPubkeyArmored []byte, now time.Time) (time.Time, error) {
+	signedPubkey, err := ReadArmoredKey(signedPubkeyArmored)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	signerPubkey, err := ReadArmoredKey(signerPubkeyArmored)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return VerifyPubkeySignatureUntil(signedPubkey, signerPubkey, now)
+}
+
+func configAt(now time.Time) *packet.Config {
+	return &packet.Config{Time: func() time.Time { return now }}
+}
+
+// readMessage decrypts a message with keys and, if signer is set, requires it
+// to be signed by signer.
+func readMessage(armoredMessage []byte, keys openpgp.EntityList, signer *openpgp.Entity, now time.Time) (msg []byte, err error) {
+	defer recoverMalformed(&err)
+
 	// Decode armored message
 	decbuf := bytes.NewBuffer(armoredMessage)
 	result, err := armor.Decode(decbuf)
@@ -164,16 +574,16 @@ func readMessage(armoredMessage []byte, keys openpgp.EntityList) ([]byte, error)
 	}
 
 	// Decrypt with private key
-	md, err := openpgp.ReadMessage(result.Body, keys, nil, nil)
+	md, err := openpgp.ReadMessage(result.Body, keys, nil, configAt(now))
 	if err != nil {
 		return nil, err
 	}
 
 	// If pubkey included, verify
-	if len(keys) == 2 {
+	if signer != nil {
 		if md.SignedBy == nil || md.SignedBy.PublicKey == nil {
 			return nil, errors.New("Verifying public key included, but message is not signed.")
-		} else if md.SignedBy.PublicKey.Fingerprint != keys[1].PrimaryKey.Fingerprint {
+		} else if !bytes.Equal(md.SignedBy.PublicKey.Fingerprint, signer.PrimaryKey.Fingerprint) {
 			return nil, errors.New("Signature pubkey doesn't match signing pubkey.")
 		}
 	}
@@ -0,0 +1,292 @@
+package envkeytest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envkey/envkey-fetch/fetch"
+	"github.com/envkey/envkey-fetch/parser"
+)
+
+// Route is one of the url shapes an envkey's response is served at.
+type Route string
+
+const (
+	// RoutePrimary is /v<version>/<id> on the EnvKey host.
+	RoutePrimary Route = "primary"
+	// RouteBackup is /envkey-backup/envs/v<version>/<id>, as on fetch.BackupHost.
+	RouteBackup Route = "backup"
+	// RouteBackupRestricted is /default/envBackup?v=<version>&id=<id>, as on
+	// fetch.BackupHostRestricted.
+	RouteBackupRestricted Route = "backup-restricted"
+)
+
+var Routes = []Route{RoutePrimary, RouteBackup, RouteBackupRestricted}
+
+const (
+	backupPath           = "/envkey-backup/envs"
+	backupRestrictedPath = "/default/envBackup"
+)
+
+// Faults are injected into responses to simulate a misbehaving host.
+type Faults struct {
+	// Latency delays every response.
+	Latency time.Duration
+
+	// ServerErrors responds with a 503 to this many requests before
+	// recovering. If negative, every request fails.
+	ServerErrors int
+
+	// NotFound responds with a 404 as if the envkey didn't exist.
+	NotFound bool
+
+	// Truncate cuts the body off halfway, after declaring its full length.
+	Truncate bool
+
+	// BadSignature tampers with the signed trusted keys so their signature
+	// no longer verifies.
+	BadSignature bool
+
+	// Routes limits the faults to some routes. If empty, they apply to every
+	// route.
+	Routes []Route
+}
+
+func (faults Faults) appliesTo(route Route) bool {
+	if len(faults.Routes) == 0 {
+		return true
+	}
+	for _, r := range faults.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// Request is a request received by a Handler.
+type Request struct {
+	Route      Route
+	Id         string
+	ApiVersion int
+	Header     http.Header
+}
+
+// Handler serves registered responses at every Route, in whichever api
+// version is requested.
+type Handler struct {
+	mu           sync.Mutex
+	responses    map[string]*parser.EnvServiceResponse
+	faults       Faults
+	serverErrors int
+	requests     []Request
+}
+
+func NewHandler() *Handler {
+	return &Handler{responses: make(map[string]*parser.EnvServiceResponse)}
+}
+
+// AddResponse serves response for the envkey with id, the part of an envkey
+// before the passphrase.
+func (handler *Handler) AddResponse(id string, response *parser.EnvServiceResponse) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.responses[id] = response
+}
+
+// AddResponseJson serves a response in any supported api version.
+func (handler *Handler) AddResponseJson(id string, data []byte) error {
+	response, _, err := parser.DecodeResponse(data, parser.DecodeOptions{})
+	if err != nil {
+		return err
+	}
+	handler.AddResponse(id, response)
+	return nil
+}
+
+// SetFaults replaces the faults injected into responses.
+func (handler *Handler) SetFaults(faults Faults) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.faults = faults
+	handler.serverErrors = faults.ServerErrors
+}
+
+// Requests returns the requests received so far.
+func (handler *Handler) Requests() []Request {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	return append([]Request{}, handler.requests...)
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, id, version, ok := parseRoute(r.URL)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	handler.mu.Lock()
+	handler.requests = append(handler.requests, Request{route, id, version, r.Header.Clone()})
+	response := handler.responses[id]
+	var faults Faults
+	if handler.faults.appliesTo(route) {
+		faults = handler.faults
+	}
+	serverError := false
+	if faults.ServerErrors != 0 && handler.serverErrors != 0 {
+		serverError = true
+		if handler.serverErrors > 0 {
+			handler.serverErrors--
+		}
+	}
+	handler.mu.Unlock()
+
+	if faults.Latency > 0 {
+		select {
+		case <-time.After(faults.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if serverError {
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if response == nil || faults.NotFound {
+		http.NotFound(w, r)
+		return
+	}
+
+	if faults.BadSignature {
+		tampered := *response
+		tampered.SignedTrustedPubkeys = tamperSigned(tampered.SignedTrustedPubkeys)
+		response = &tampered
+	}
+
+	body, err := parser.EncodeResponse(response, version)
+	if err != nil {
+		// Like the real host, there's nothing at an unsupported version
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set(fetch.ApiVersionHeader, strconv.Itoa(version))
+	if faults.Truncate {
+		body = body[:len(body)/2]
+	}
+	w.Write(body)
+}
+
+// parseRoute matches a url to a route and returns the envkey id and api
+// version requested.
+func parseRoute(u *url.URL) (Route, string, int, bool) {
+	if u.Path == backupRestrictedPath {
+		version, err := strconv.Atoi(u.Query().Get("v"))
+		id := u.Query().Get("id")
+		return RouteBackupRestricted, id, version, err == nil && id != ""
+	}
+
+	route := RoutePrimary
+	path := u.Path
+	if strings.HasPrefix(path, backupPath+"/") {
+		route = RouteBackup
+		path = strings.TrimPrefix(path, backupPath)
+	}
+
+	split := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(split) != 2 || !strings.HasPrefix(split[0], "v") || split[1] == "" {
+		return "", "", 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(split[0], "v"))
+	if err != nil {
+		return "", "", 0, false
+	}
+	return route, split[1], version, true
+}
+
+// tamperSigned changes the text of a cleartext signed message, keeping it
+// valid json, so that its signature no longer matches.
+func tamperSigned(signed string) string {
+	start := strings.Index(signed, "-----BEGIN PGP SIGNED MESSAGE-----")
+	if start == -1 {
+		return signed + " "
+	}
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := strings.Index(signed[start:], sep); i != -1 {
+			textStart := start + i + len(sep) + 1
+			if textStart > len(signed) {
+				break
+			}
+			return signed[:textStart] + " " + signed[textStart:]
+		}
+	}
+	return signed + " "
+}
+
+// Server is a Handler listening on a random localhost port over http, and
+// another over https for the backup routes, which are always fetched over
+// https.
+type Server struct {
+	*Handler
+
+	// Host is the host part of an envkey served by this server, like
+	// localhost:12345, which fetch requests over http.
+	Host string
+
+	// TLSHost is the host of the https listener, like 127.0.0.1:12346.
+	TLSHost string
+
+	server    *httptest.Server
+	tlsServer *httptest.Server
+}
+
+func NewServer() *Server {
+	handler := NewHandler()
+	server := httptest.NewServer(handler)
+	tlsServer := httptest.NewTLSServer(handler)
+
+	return &Server{
+		Handler:   handler,
+		Host:      strings.Replace(server.Listener.Addr().String(), "127.0.0.1", "localhost", 1),
+		TLSHost:   tlsServer.Listener.Addr().String(),
+		server:    server,
+		tlsServer: tlsServer,
+	}
+}
+
+// Envkey returns an envkey for id and passphrase that's fetched from this
+// server.
+func (server *Server) Envkey(id, pw string) string {
+	return strings.Join([]string{id, pw, server.Host}, "-")
+}
+
+// BackupHost and BackupHostRestricted are values for fetch.BackupHost and
+// fetch.BackupHostRestricted that serve backups from this server. They're
+// only reachable with Client.
+func (server *Server) BackupHost() string {
+	return server.TLSHost + backupPath
+}
+
+func (server *Server) BackupHostRestricted() string {
+	return server.TLSHost + backupRestrictedPath
+}
+
+// Client returns an http client that trusts the server's https certificate,
+// for use as fetch.Client.
+func (server *Server) Client() *http.Client {
+	return server.tlsServer.Client()
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+	server.tlsServer.Close()
+}
@@ -0,0 +1,233 @@
+package envkeytest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/envkey/envkey-fetch/envkeytest"
+	"github.com/envkey/envkey-fetch/fetch"
+	"github.com/envkey/envkey-fetch/parser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var response = parser.EnvServiceResponse{
+	Env:                    "env",
+	EncryptedPrivkey:       "privkey",
+	PubkeyArmored:          "pubkey",
+	SignedTrustedPubkeys:   "-----BEGIN PGP SIGNED MESSAGE-----\r\nHash: SHA256\r\n\r\n{\"id\":{}}\r\n-----BEGIN PGP SIGNATURE-----",
+	SignedById:             "signer",
+	SignedByPubkeyArmored:  "signer-pubkey",
+	SignedByTrustedPubkeys: "signer-trusted",
+	AllowCaching:           true,
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string, http.Header) {
+	res, err := client.Get(url)
+	if !assert.Nil(t, err) {
+		return 0, "", nil
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body), res.Header
+}
+
+func TestServerRoutes(t *testing.T) {
+	parser.EnableExperimentalApiVersions()
+	server := envkeytest.NewServer()
+	defer server.Close()
+	server.AddResponse("validkey", &response)
+	client := server.Client()
+
+	v1, _ := parser.EncodeResponse(&response, 1)
+	v2, _ := parser.EncodeResponse(&response, 2)
+
+	tests := []struct {
+		url     string
+		status  int
+		body    string
+		route   envkeytest.Route
+		version int
+	}{
+		{"http://" + server.Host + "/v1/validkey", http.StatusOK, string(v1), envkeytest.RoutePrimary, 1},
+		{"http://" + server.Host + "/v2/validkey?clientName=test", http.StatusOK, string(v2), envkeytest.RoutePrimary, 2},
+		{"https://" + server.BackupHost() + "/v1/validkey", http.StatusOK, string(v1), envkeytest.RouteBackup, 1},
+		{"https://" + server.BackupHostRestricted() + "?v=2&id=validkey", http.StatusOK, string(v2), envkeytest.RouteBackupRestricted, 2},
+		{"http://" + server.Host + "/v1/invalid", http.StatusNotFound, "", envkeytest.RoutePrimary, 1},
+		{"http://" + server.Host + "/v3/validkey", http.StatusNotFound, "", envkeytest.RoutePrimary, 3},
+	}
+
+	for _, test := range tests {
+		status, body, header := get(t, client, test.url)
+		assert.Equal(t, test.status, status, test.url)
+		if test.status == http.StatusOK {
+			assert.Equal(t, test.body, body, test.url)
+			assert.Equal(t, "application/json", header.Get("Content-Type"))
+		}
+
+		requests := server.Requests()
+		last := requests[len(requests)-1]
+		assert.Equal(t, test.route, last.Route, test.url)
+		assert.Equal(t, test.version, last.ApiVersion, test.url)
+	}
+
+	status, _, _ := get(t, client, "http://"+server.Host+"/other")
+	assert.Equal(t, http.StatusNotFound, status, "Should not serve other paths.")
+
+	assert.Equal(t, "validkey-pw-"+server.Host, server.Envkey("validkey", "pw"))
+}
+
+func TestServerFaults(t *testing.T) {
+	server := envkeytest.NewServer()
+	defer server.Close()
+	server.AddResponse("validkey", &response)
+	client := server.Client()
+	primary := "http://" + server.Host + "/v1/validkey"
+	backup := "https://" + server.BackupHost() + "/v1/validkey"
+
+	server.SetFaults(envkeytest.Faults{ServerErrors: 2})
+	for i := 0; i < 2; i++ {
+		status, _, _ := get(t, client, primary)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	}
+	status, _, _ := get(t, client, primary)
+	assert.Equal(t, http.StatusOK, status, "Should recover after the server errors.")
+
+	server.SetFaults(envkeytest.Faults{ServerErrors: -1, Routes: []envkeytest.Route{envkeytest.RoutePrimary}})
+	for i := 0; i < 3; i++ {
+		status, _, _ = get(t, client, primary)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	}
+	status, _, _ = get(t, client, backup)
+	assert.Equal(t, http.StatusOK, status, "Should only fault the given routes.")
+
+	server.SetFaults(envkeytest.Faults{NotFound: true})
+	status, _, _ = get(t, client, primary)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	server.SetFaults(envkeytest.Faults{Latency: 100 * time.Millisecond})
+	start := time.Now()
+	status, _, _ = get(t, client, primary)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "Should delay the response.")
+
+	server.SetFaults(envkeytest.Faults{BadSignature: true})
+	_, body, header := get(t, client, primary)
+	assert.Equal(t, "1", header.Get(fetch.ApiVersionHeader))
+	tampered, _, err := parser.DecodeResponse([]byte(body), parser.DecodeOptions{})
+	if assert.Nil(t, err, "Should still be a well formed response.") {
+		assert.NotEqual(t, response.SignedTrustedPubkeys, tampered.SignedTrustedPubkeys)
+		assert.Contains(t, tampered.SignedTrustedPubkeys, "{ \"id\":{}}")
+		assert.Equal(t, response.Env, tampered.Env)
+	}
+
+	server.SetFaults(envkeytest.Faults{Truncate: true})
+	res, err := client.Get(primary)
+	if assert.Nil(t, err) {
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NotNil(t, err, "Should cut the body off.")
+	}
+}
+
+func TestAddResponseJson(t *testing.T) {
+	parser.EnableExperimentalApiVersions()
+	handler := envkeytest.NewHandler()
+	v2, _ := parser.EncodeResponse(&response, 2)
+	assert.Nil(t, handler.AddResponseJson("validkey", v2))
+	assert.NotNil(t, handler.AddResponseJson("invalid", []byte("{")))
+}
+
+func TestFixture(t *testing.T) {
+	env := `{"B":"2","A":1.50}`
+	overrides := `{"B":"overridden"}`
+	chain := []envkeytest.Keyable{{Id: "owner"}, {Id: "admin", InvitedBy: "owner"}, {Id: "dev", InvitedBy: "admin"}}
+
+	tests := []struct {
+		name    string
+		options envkeytest.FixtureOptions
+		result  string
+		err     string
+	}{
+		{"default", envkeytest.FixtureOptions{Env: env}, env, ""},
+		{"empty env", envkeytest.FixtureOptions{}, "{}", ""},
+		{"invite chain", envkeytest.FixtureOptions{Env: env, Keyables: chain}, env, ""},
+		{"root signer", envkeytest.FixtureOptions{Env: env, Keyables: chain, Signer: "owner"}, env, ""},
+		{"inheritance overrides", envkeytest.FixtureOptions{Env: env, Keyables: chain, InheritanceOverrides: overrides, InheritanceOverridesSigner: "admin"}, `{"B":"overridden","A":1.50}`, ""},
+		{"broken env signature", envkeytest.FixtureOptions{Env: env, Break: envkeytest.BreakEnvSignature}, "", "message is not signed."},
+		{"broken trusted keys signature", envkeytest.FixtureOptions{Env: env, Break: envkeytest.BreakTrustedKeysSignature}, "", "signature"},
+		{"broken invite signature", envkeytest.FixtureOptions{Env: env, Keyables: chain, Break: envkeytest.BreakInviteSignature}, "", "Invite of dev by admin invalid"},
+		{"broken untrusted signer", envkeytest.FixtureOptions{Env: env, Keyables: chain, Break: envkeytest.BreakUntrustedSigner}, "", "Signer not trusted."},
+		{"broken pubkey", envkeytest.FixtureOptions{Env: env, Break: envkeytest.BreakPubkey}, "", "Pubkey fingerprint does not match private key fingerprint."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture, err := envkeytest.NewFixture(test.options)
+			if !assert.Nil(t, err, "Should generate the fixture.") {
+				return
+			}
+
+			res, err := fixture.Response.Parse(fixture.Passphrase)
+			if test.err != "" {
+				if assert.NotNil(t, err, "Should fail to verify.") {
+					assert.Contains(t, err.Error(), test.err)
+				}
+				return
+			}
+			assert.Nil(t, err, "Should verify.")
+			assert.Equal(t, test.result, res)
+		})
+	}
+}
+
+func TestFixtureEnvkey(t *testing.T) {
+	fixture, err := envkeytest.NewFixture(envkeytest.FixtureOptions{})
+	if assert.Nil(t, err) {
+		assert.Len(t, fixture.Id, 20)
+		assert.Len(t, fixture.Passphrase, 16)
+		assert.Equal(t, fixture.Id+"-"+fixture.Passphrase, fixture.Envkey)
+
+		_, err = fixture.Response.Parse("wrong")
+		assert.NotNil(t, err, "Should require the passphrase.")
+	}
+
+	fixture, err = envkeytest.NewFixture(envkeytest.FixtureOptions{Id: "validkey", Passphrase: "pw", Host: "localhost:3000"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "validkey-pw-localhost:3000", fixture.Envkey)
+	}
+
+	invalid := []envkeytest.FixtureOptions{
+		{Env: "[]"},
+		{InheritanceOverrides: "{"},
+		{Signer: "ghost"},
+		{Keyables: []envkeytest.Keyable{{Id: "dev", InvitedBy: "ghost"}}},
+		{Keyables: []envkeytest.Keyable{{Id: "owner"}, {Id: "owner"}}},
+		{Break: envkeytest.BreakInviteSignature},
+		{Break: "unknown"},
+		{Id: "has-dash"},
+	}
+	for _, options := range invalid {
+		_, err = envkeytest.NewFixture(options)
+		assert.NotNil(t, err, "Should reject %+v.", options)
+	}
+}
+
+func TestServeFixture(t *testing.T) {
+	parser.EnableExperimentalApiVersions()
+	server := envkeytest.NewServer()
+	defer server.Close()
+
+	fixture, err := envkeytest.NewFixture(envkeytest.FixtureOptions{Env: `{"A":"1"}`, Host: server.Host, AllowCaching: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	server.AddResponse(fixture.Id, fixture.Response)
+
+	fetch.InitHttpClient(2.0)
+	res, err := fetch.Fetch(fixture.Envkey, fetch.FetchOptions{TimeoutSeconds: 2.0, ApiVersion: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"A":"1"}`, res)
+}
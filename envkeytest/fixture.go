@@ -0,0 +1,391 @@
+package envkeytest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/envkey/envkey-fetch/crypto"
+	"github.com/envkey/envkey-fetch/parser"
+	"github.com/envkey/envkey-fetch/trust"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Keyable is a user or server key in a fixture's web of trust. A keyable
+// without InvitedBy is a root trusted by the envkey's creator, and the rest
+// are trusted through a chain of invitations back to a root.
+type Keyable struct {
+	Id        string
+	InvitedBy string
+}
+
+// Break is a way a fixture can be deliberately broken so that it fails to
+// verify.
+type Break string
+
+const (
+	// BreakEnvSignature signs the env with a key other than the signer's.
+	BreakEnvSignature Break = "env-signature"
+	// BreakTrustedKeysSignature signs the envkey's trusted keys with a key
+	// other than the envkey's.
+	BreakTrustedKeysSignature Break = "trusted-keys-signature"
+	// BreakInviteSignature certifies the signer's invite key with a key other
+	// than its inviter's.
+	BreakInviteSignature Break = "invite-signature"
+	// BreakUntrustedSigner leaves the signer out of the trusted keys.
+	BreakUntrustedSigner Break = "untrusted-signer"
+	// BreakPubkey serves a pubkey that doesn't match the envkey's private key.
+	BreakPubkey Break = "pubkey"
+)
+
+var Breaks = []Break{BreakEnvSignature, BreakTrustedKeysSignature, BreakInviteSignature, BreakUntrustedSigner, BreakPubkey}
+
+func (b Break) known() bool {
+	for _, known := range Breaks {
+		if b == known {
+			return true
+		}
+	}
+	return false
+}
+
+type FixtureOptions struct {
+	// Env is the json object encrypted for the envkey. If empty, it's {}.
+	Env string
+
+	// InheritanceOverrides, if set, is a json object of overrides signed by
+	// InheritanceOverridesSigner.
+	InheritanceOverrides string
+
+	// Keyables form the web of trust. If empty, a single root "owner" is
+	// generated.
+	Keyables []Keyable
+
+	// Signer and InheritanceOverridesSigner are ids of keyables. Signer
+	// defaults to the last keyable and InheritanceOverridesSigner to Signer.
+	Signer                     string
+	InheritanceOverridesSigner string
+
+	// Id and Passphrase make up the envkey, and are random if empty. Host,
+	// if set, is appended, e.g. the Host of a Server.
+	Id         string
+	Passphrase string
+	Host       string
+
+	AllowCaching bool
+
+	// Break, if set, generates a variant that fails to verify.
+	Break Break
+}
+
+// Fixture is a generated envkey and the response the EnvKey host would serve
+// for it.
+type Fixture struct {
+	Envkey     string
+	Id         string
+	Passphrase string
+	Response   *parser.EnvServiceResponse
+}
+
+// keyConfig generates EdDSA keys, which are much faster to generate than the
+// RSA keys EnvKey uses, dated a minute ago so they're valid immediately.
+func keyConfig() *packet.Config {
+	created := time.Now().Add(-time.Minute)
+	return &packet.Config{
+		Algorithm: packet.PubKeyAlgoEdDSA,
+		Time:      func() time.Time { return created },
+	}
+}
+
+// NewFixture generates keys for the envkey and every keyable, certifies the
+// invitations between them, and encrypts and signs the env.
+func NewFixture(options FixtureOptions) (*Fixture, error) {
+	var err error
+	config := keyConfig()
+
+	env := options.Env
+	if env == "" {
+		env = "{}"
+	}
+	_, err = parser.ParseEnv([]byte(env))
+	if err != nil {
+		return nil, err
+	}
+	if options.InheritanceOverrides != "" {
+		_, err = parser.ParseEnv([]byte(options.InheritanceOverrides))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Break != "" && !options.Break.known() {
+		return nil, errors.New("Unknown break " + string(options.Break) + ".")
+	}
+
+	keyables := options.Keyables
+	if len(keyables) == 0 {
+		keyables = []Keyable{{Id: "owner"}}
+	}
+	signerId := options.Signer
+	if signerId == "" {
+		signerId = keyables[len(keyables)-1].Id
+	}
+	inheritanceOverridesSignerId := options.InheritanceOverridesSigner
+	if inheritanceOverridesSignerId == "" {
+		inheritanceOverridesSignerId = signerId
+	}
+
+	keys := make(map[string]*openpgp.Entity)
+	invites := make(map[string]*openpgp.Entity)
+	for _, keyable := range keyables {
+		if keyable.Id == "" {
+			return nil, errors.New("Keyable id is empty.")
+		} else if keys[keyable.Id] != nil {
+			return nil, errors.New("Duplicate keyable " + keyable.Id + ".")
+		}
+		keys[keyable.Id], err = newEntity(keyable.Id, config)
+		if err != nil {
+			return nil, err
+		}
+		if keyable.InvitedBy != "" {
+			invites[keyable.Id], err = newEntity(keyable.Id+"-invite", config)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, id := range []string{signerId, inheritanceOverridesSignerId} {
+		if keys[id] == nil {
+			return nil, errors.New("Unknown signer " + id + ".")
+		}
+	}
+
+	envkeyKey, err := newEntity("envkey", config)
+	if err != nil {
+		return nil, err
+	}
+	impostor, err := newEntity("impostor", config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each keyable's invite key is certified by its inviter, and its own key
+	// by its invite key
+	for _, keyable := range keyables {
+		if keyable.InvitedBy == "" {
+			if options.Break == BreakInviteSignature && keyable.Id == signerId {
+				return nil, errors.New("Signer " + signerId + " has no invitation to break.")
+			}
+			continue
+		}
+		inviter := keys[keyable.InvitedBy]
+		if inviter == nil {
+			return nil, errors.New("Unknown inviter " + keyable.InvitedBy + " of " + keyable.Id + ".")
+		}
+		if options.Break == BreakInviteSignature && keyable.Id == signerId {
+			inviter = impostor
+		}
+
+		invite := invites[keyable.Id]
+		err = invite.SignIdentity(identity(invite), inviter, config)
+		if err != nil {
+			return nil, err
+		}
+		err = keys[keyable.Id].SignIdentity(identity(keys[keyable.Id]), invite, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	creatorTrusted := make(trust.TrustedKeyablesMap)
+	signerTrusted := make(trust.TrustedKeyablesMap)
+	for _, keyable := range keyables {
+		if options.Break == BreakUntrustedSigner && keyable.Id == signerId {
+			continue
+		}
+		trusted := trust.TrustedKeyable{InvitedById: keyable.InvitedBy}
+		trusted.PubkeyArmored, err = armorPubkey(keys[keyable.Id])
+		if err != nil {
+			return nil, err
+		}
+		if keyable.InvitedBy == "" {
+			creatorTrusted[keyable.Id] = trusted
+		} else {
+			trusted.InvitePubkeyArmored, err = armorPubkey(invites[keyable.Id])
+			if err != nil {
+				return nil, err
+			}
+		}
+		signerTrusted[keyable.Id] = trusted
+	}
+
+	response := &parser.EnvServiceResponse{AllowCaching: options.AllowCaching}
+
+	response.PubkeyArmored, err = armorPubkey(envkeyKey)
+	if options.Break == BreakPubkey {
+		response.PubkeyArmored, err = armorPubkey(impostor)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	trustedKeysSigner := envkeyKey
+	if options.Break == BreakTrustedKeysSignature {
+		trustedKeysSigner = impostor
+	}
+	response.SignedTrustedPubkeys, err = signTrusted(creatorTrusted, trustedKeysSigner)
+	if err != nil {
+		return nil, err
+	}
+
+	envSigner := keys[signerId]
+	if options.Break == BreakEnvSignature {
+		envSigner = impostor
+	}
+	response.SignedById = signerId
+	response.Env, response.SignedByPubkeyArmored, response.SignedByTrustedPubkeys, err = signedPayload(env, envkeyKey, keys[signerId], envSigner, signerTrusted)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.InheritanceOverrides != "" {
+		signer := keys[inheritanceOverridesSignerId]
+		response.InheritanceOverridesSignedById = inheritanceOverridesSignerId
+		response.InheritanceOverrides, response.InheritanceOverridesSignedByPubkeyArmored, response.InheritanceOverridesSignedByTrustedPubkeys, err = signedPayload(options.InheritanceOverrides, envkeyKey, signer, signer, signerTrusted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fixture := &Fixture{Id: options.Id, Passphrase: options.Passphrase, Response: response}
+	if fixture.Id == "" {
+		fixture.Id, err = randomString(20)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fixture.Passphrase == "" {
+		fixture.Passphrase, err = randomString(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.Contains(fixture.Id, "-") || strings.Contains(fixture.Passphrase, "-") {
+		return nil, errors.New("Envkey id and passphrase can't contain '-'.")
+	}
+
+	response.EncryptedPrivkey, err = armorEncryptedPrivkey(envkeyKey, fixture.Passphrase, config)
+	if err != nil {
+		return nil, err
+	}
+
+	envkey := []string{fixture.Id, fixture.Passphrase}
+	if options.Host != "" {
+		envkey = append(envkey, options.Host)
+	}
+	fixture.Envkey = strings.Join(envkey, "-")
+
+	return fixture, nil
+}
+
+// signedPayload encrypts payload for the envkey, signed by signer, and returns
+// it along with the pubkey of the signer and the trusted keys it signed.
+func signedPayload(payload string, envkeyKey, signer, payloadSigner *openpgp.Entity, trusted trust.TrustedKeyablesMap) (string, string, string, error) {
+	encrypted, err := crypto.EncryptAndSign([]byte(payload), openpgp.EntityList{envkeyKey}, payloadSigner)
+	if err != nil {
+		return "", "", "", err
+	}
+	pubkey, err := armorPubkey(signer)
+	if err != nil {
+		return "", "", "", err
+	}
+	signedTrusted, err := signTrusted(trusted, signer)
+	if err != nil {
+		return "", "", "", err
+	}
+	return string(encrypted), pubkey, signedTrusted, nil
+}
+
+func signTrusted(trusted trust.TrustedKeyablesMap, signer *openpgp.Entity) (string, error) {
+	trustedJson, err := json.Marshal(trusted)
+	if err != nil {
+		return "", err
+	}
+	signed, err := crypto.SignCleartext(trustedJson, signer)
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+func newEntity(name string, config *packet.Config) (*openpgp.Entity, error) {
+	return openpgp.NewEntity(name, "", name+"@envkey.com", config)
+}
+
+func identity(entity *openpgp.Entity) string {
+	for name := range entity.Identities {
+		return name
+	}
+	return ""
+}
+
+func armorPubkey(entity *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	err = entity.Serialize(w)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// armorEncryptedPrivkey encrypts entity's private keys with passphrase, after
+// which entity can no longer sign, and serializes them.
+func armorEncryptedPrivkey(entity *openpgp.Entity, passphrase string, config *packet.Config) (string, error) {
+	err := entity.EncryptPrivateKeys([]byte(passphrase), config)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	err = entity.SerializePrivateWithoutSigning(w, config)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+const randomChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = randomChars[int(b[i])%len(randomChars)]
+	}
+	return string(b), nil
+}
@@ -2,24 +2,29 @@ package fetch
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
-	"net"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/certifi/gocertifi"
 	"github.com/envkey/envkey-fetch/cache"
+	"github.com/envkey/envkey-fetch/config"
+	"github.com/envkey/envkey-fetch/crypto"
 	"github.com/envkey/envkey-fetch/parser"
+	"github.com/envkey/envkey-fetch/trust"
 	"github.com/envkey/envkey-fetch/version"
 	multierror "github.com/hashicorp/go-multierror"
 )
@@ -33,6 +38,64 @@ type FetchOptions struct {
 	TimeoutSeconds float64
 	Retries        uint8
 	RetryBackoff   float64
+
+	// Interpolate expands ${VAR} references between config values, optionally
+	// falling back to the process environment.
+	Interpolate           bool
+	InterpolateProcessEnv bool
+
+	// PinnedRoots and the entry for this envkey in PinFile restrict which
+	// root signers the trust chain may end at. A PinFile without an entry
+	// for the envkey is an error rather than no pinning.
+	PinnedRoots trust.Pins
+	PinFile     string
+
+	// Explain records how each signer's trust chain was verified in
+	// Metadata.TrustChain. On failure the returned error is a
+	// *trust.ExplainedError.
+	Explain bool
+
+	// MaxResponseBytes limits the size of a response, whether served or
+	// cached. If zero, DefaultMaxResponseBytes is used.
+	MaxResponseBytes int64
+
+	// StrictDecode rejects responses with unknown fields.
+	StrictDecode bool
+
+	// ApiVersion is the api version requested in urls. If zero, the package
+	// ApiVersion is used. The response may still be of any version in
+	// parser.SupportedApiVersions, as negotiated by ApiVersionHeader.
+	ApiVersion int
+
+	// Snapshot, if set, is a snapshot file to read the response from instead
+	// of fetching it, verified as of when it was fetched. SnapshotMaxAge, if
+	// set, refuses snapshots fetched longer ago.
+	Snapshot       string
+	SnapshotMaxAge time.Duration
+
+	// Proxy is an http, https or socks5 proxy url for every request except
+	// to hosts in NoProxy, or the NO_PROXY environment variable if empty.
+	// Without Proxy, HTTPS_PROXY or HTTP_PROXY is used, likewise except to
+	// hosts in NoProxy or NO_PROXY.
+	Proxy   string
+	NoProxy string
+
+	// CAFile is a PEM bundle of certificates trusted in addition to the
+	// system roots, e.g. a private CA for a self-hosted EnvKey host.
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key for
+	// mutual TLS.
+	//
+	// With any of these or TLSPins set, requests use a client built for, and
+	// cached by, these settings instead of Client.
+	CAFile         string
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// TLSPins pins the public keys of hosts like DefaultHost, the backup
+	// hosts or a custom host, by host name. TLSPinsReportOnly logs
+	// mismatches to stderr instead of refusing the connection.
+	TLSPins           TLSPins
+	TLSPinsReportOnly bool
 }
 
 var DefaultHost = "env.envkey.com"
@@ -40,8 +103,87 @@ var BackupHost = "s3-eu-west-1.amazonaws.com/envkey-backup/envs"
 var BackupHostRestricted = "me66hg5t17.execute-api.eu-west-1.amazonaws.com/default/envBackup"
 var ApiVersion = 1
 
+// AcceptApiVersionsHeader lists the response versions the client can decode,
+// and a server answers with the version it chose in ApiVersionHeader. A
+// response without the header may declare its version in an api_version
+// field instead.
+const AcceptApiVersionsHeader = "X-Envkey-Accept-Api-Versions"
+const ApiVersionHeader = "X-Envkey-Api-Version"
+
+// DefaultMaxResponseBytes is far larger than any real response, but keeps a
+// misbehaving proxy or host from exhausting memory.
+const DefaultMaxResponseBytes int64 = 10 << 20
+
 var Client *http.Client
 
+var ErrWrongPassphrase = errors.New("ENVKEY invalid: wrong passphrase")
+var ErrRootNotPinned = errors.New("ENVKEY invalid: signer not trusted by a pinned root")
+
+// ResponseTooLargeError is returned when a response declares or has a body
+// larger than the maximum response size.
+type ResponseTooLargeError struct {
+	Url   string
+	Limit int64
+}
+
+func (err *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response from %s is larger than %d bytes", err.Url, err.Limit)
+}
+
+// ContentTypeError is returned for a response that declares a content type
+// that can't be a json response, like an html error page from a proxy.
+type ContentTypeError struct {
+	Url         string
+	ContentType string
+}
+
+func (err *ContentTypeError) Error() string {
+	return fmt.Sprintf("response from %s has unexpected content type %q", err.Url, err.ContentType)
+}
+
+// ContentLengthError is returned when a response's Content-Length is invalid
+// or doesn't match the length of its body.
+type ContentLengthError struct {
+	Url           string
+	ContentLength string
+	Read          int64
+}
+
+func (err *ContentLengthError) Error() string {
+	if err.Read < 0 {
+		return fmt.Sprintf("response from %s has invalid Content-Length %q", err.Url, err.ContentLength)
+	}
+	return fmt.Sprintf("response from %s has Content-Length %s but a %d byte body", err.Url, err.ContentLength, err.Read)
+}
+
+// jsonContentTypes are the content types a response may be served with. S3
+// backups may be served as generic binary or text.
+var jsonContentTypes = map[string]bool{
+	"application/json":         true,
+	"text/json":                true,
+	"text/plain":               true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// verifiedLinks memoizes verified trust chain invitations for each envkey id
+// for the life of the process, and is persisted alongside the cache when
+// caching is enabled. Each envkey has its own memo, so what's persisted for
+// it, authenticated with its passphrase, is only what was verified for it.
+var verifiedLinksMu sync.Mutex
+var verifiedLinks = make(map[string]*trust.VerifiedLinks)
+
+func envkeyVerifiedLinks(envkeyParam string) *trust.VerifiedLinks {
+	verifiedLinksMu.Lock()
+	defer verifiedLinksMu.Unlock()
+	links := verifiedLinks[envkeyParam]
+	if links == nil {
+		links = trust.NewVerifiedLinks()
+		verifiedLinks[envkeyParam] = links
+	}
+	return links
+}
+
 type httpChannelResponse struct {
 	response *http.Response
 	url      string
@@ -53,13 +195,262 @@ type httpChannelErr struct {
 }
 
 func Fetch(envkey string, options FetchOptions) (string, error) {
+	decrypted, _, err := fetchDecrypted(envkey, options)
+	if err != nil {
+		return "", err
+	}
+
+	return decrypted.ToJson()
+}
+
+func FetchWithMetadata(envkey string, options FetchOptions) (*Result, error) {
+	decrypted, metadata, err := fetchDecrypted(envkey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := decrypted.ToJson()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{env, *metadata}, nil
+}
+
+func FetchConfig(envkey string, options FetchOptions) (*config.Config, error) {
+	decrypted, _, err := fetchDecrypted(envkey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypted.Env().Config(), nil
+}
+
+func fetchDecrypted(envkey string, options FetchOptions) (*parser.DecryptedVerifiedResponse, *Metadata, error) {
+	if len(strings.Split(envkey, "-")) < 2 {
+		return nil, nil, errors.New("ENVKEY invalid")
+	}
+
+	pinnedRoots, err := resolvePinnedRoots(envkey, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := new(Metadata)
+	response, fetchCache, envkeyParam, pw, err := fetchResponse(envkey, options, metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fetchCache != nil {
+		readVerifiedLinks(fetchCache, envkeyParam, pw, options)
+	}
+
+	res, err := parseResponse(response, envkeyParam, pw, metadata.verifyAt(), pinnedRoots, options)
+
+	// Ensure the cache write started while fetching finished, so it can't
+	// land after the entry is deleted below (don't worry about error). Read
+	// and Delete also send on Done, but getJson drains it before the write,
+	// so this receives the write's result.
+	if fetchCache != nil && response.AllowCaching {
+		<-fetchCache.Done
+	}
+
+	if err != nil {
+		if fetchCache != nil {
+			fetchCache.Delete(envkeyParam)
+		}
+		return nil, nil, err
+	}
+
+	err = finishDecrypted(res, metadata, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fetchCache != nil && response.AllowCaching {
+		writeVerifiedLinks(fetchCache, envkeyParam, pw, options)
+	}
+
+	return res, metadata, nil
+}
+
+// DecryptResponse decrypts and verifies a saved response, like a raw
+// response from the EnvKey host or a cache file, with the same validation and
+// trust verification as a fetch but no network access. Keys and signatures are
+// verified as of at, or now if at is zero. A response that doesn't declare its
+// api version is decoded as options.ApiVersion.
+func DecryptResponse(envkey string, data []byte, at time.Time, options FetchOptions) (*Result, error) {
+	if len(strings.Split(envkey, "-")) < 2 {
+		return nil, errors.New("ENVKEY invalid")
+	}
+
+	pinnedRoots, err := resolvePinnedRoots(envkey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	decodeOptions := parser.DecodeOptions{DisallowUnknownFields: options.StrictDecode}
+	if declared, _ := parser.ResponseApiVersion(data); declared == 0 {
+		decodeOptions.ApiVersion = options.ApiVersion
+	}
+	response, version, err := parser.DecodeResponse(data, decodeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if at.IsZero() {
+		at = time.Now()
+	}
+	metadata := &Metadata{Source: SourceFile, ApiVersion: version}
+	envkeyParam, pw, _ := splitEnvkey(envkey)
+
+	res, err := parseResponse(response, envkeyParam, pw, at, pinnedRoots, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = finishDecrypted(res, metadata, options)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := res.ToJson()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{env, *metadata}, nil
+}
+
+// DecryptFile is DecryptResponse for a response saved to path. If at is zero,
+// it's verified as of now, like a fetch. The file's modification time isn't
+// used since anyone can set it.
+func DecryptFile(envkey, path string, at time.Time, options FetchOptions) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limit := options.maxResponseBytes()
+	data, err := ioutil.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > limit {
+		return nil, &ResponseTooLargeError{path, limit}
+	}
+
+	res, err := DecryptResponse(envkey, data, at, options)
+	if err != nil {
+		return nil, err
+	}
+	res.Metadata.File = path
+	return res, nil
+}
+
+// parseResponse decrypts and verifies a response as of now, mapping errors to
+// the ones returned by Fetch.
+func parseResponse(response *parser.EnvServiceResponse, envkeyParam, pw string, now time.Time, pinnedRoots trust.Pins, options FetchOptions) (*parser.DecryptedVerifiedResponse, error) {
+	if options.VerboseOutput {
+		fmt.Fprintln(os.Stderr, "Parsing and decrypting response...")
+	}
+	res, err := response.ParseDecryptedWithOptions(pw, parser.ParseOptions{
+		CurrentTime:   now,
+		PinnedRoots:   pinnedRoots,
+		VerifiedLinks: envkeyVerifiedLinks(envkeyParam),
+	})
+	if err == nil {
+		return res, nil
+	}
+
+	if options.VerboseOutput {
+		fmt.Fprintln(os.Stderr, "Error parsing and decrypting:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	fetchErr := errors.New("ENVKEY invalid")
+	if errors.Is(err, crypto.ErrWrongPassphrase) {
+		fetchErr = ErrWrongPassphrase
+	} else if errors.Is(err, trust.ErrRootNotPinned) {
+		fetchErr = ErrRootNotPinned
+	}
+
+	var explainedErr *trust.ExplainedError
+	if options.Explain && errors.As(err, &explainedErr) {
+		return nil, &trust.ExplainedError{Err: fetchErr, Explanation: explainedErr.Explanation}
+	}
+	return nil, fetchErr
+}
+
+// finishDecrypted records the verified response in metadata and interpolates
+// it if requested.
+func finishDecrypted(res *parser.DecryptedVerifiedResponse, metadata *Metadata, options FetchOptions) error {
+	metadata.Latency.KeyParsing = res.Timings.KeyParsing
+	metadata.Latency.TrustChain = res.Timings.TrustChain
+	metadata.Latency.Decryption = res.Timings.Decryption
+	metadata.SignerId = res.Signer.Id
+	metadata.InheritanceOverridesApplied = res.HasInheritanceOverrides()
+	if res.InheritanceOverridesSigner != nil {
+		metadata.InheritanceOverridesSignerId = res.InheritanceOverridesSigner.Id
+	}
+	if options.Explain {
+		metadata.TrustChain = []*trust.Explanation{res.SignerExplanation}
+		if res.InheritanceOverridesSignerExplanation != nil {
+			metadata.TrustChain = append(metadata.TrustChain, res.InheritanceOverridesSignerExplanation)
+		}
+	}
+
+	if options.Interpolate {
+		return res.Interpolate(parser.InterpolateOptions{ProcessEnv: options.InterpolateProcessEnv})
+	}
+	return nil
+}
+
+func FetchTrustGraph(envkey string, options FetchOptions) (*trust.Graph, error) {
 	if len(strings.Split(envkey, "-")) < 2 {
-		return "", errors.New("ENVKEY invalid")
+		return nil, errors.New("ENVKEY invalid")
+	}
+
+	pinnedRoots, err := resolvePinnedRoots(envkey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := new(Metadata)
+	response, _, _, pw, err := fetchResponse(envkey, options, metadata)
+	if err != nil {
+		return nil, err
 	}
 
-	// may be initalized already when mocking for tests
-	if Client == nil {
-		InitHttpClient(options.TimeoutSeconds)
+	graph, err := response.TrustGraph(pw, parser.ParseOptions{
+		CurrentTime: metadata.verifyAt(),
+		PinnedRoots: pinnedRoots,
+	})
+	if err != nil {
+		if options.VerboseOutput {
+			fmt.Fprintln(os.Stderr, "Error parsing response:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if errors.Is(err, crypto.ErrWrongPassphrase) {
+			return nil, ErrWrongPassphrase
+		}
+		return nil, errors.New("ENVKEY invalid")
+	}
+
+	return graph, nil
+}
+
+// fetchResponse fetches the encrypted response for an envkey, falling back to
+// the cache if enabled, or reads it from options.Snapshot, and records where it
+// came from in metadata.
+func fetchResponse(envkey string, options FetchOptions, metadata *Metadata) (*parser.EnvServiceResponse, *cache.Cache, string, string, error) {
+	if options.Snapshot != "" {
+		response, envkeyParam, pw, err := snapshotResponse(envkey, options, metadata)
+		if err != nil {
+			return nil, nil, "", "", err
+		}
+		return response, nil, envkeyParam, pw, nil
 	}
 
 	var fetchCache *cache.Cache
@@ -78,42 +469,23 @@ func Fetch(envkey string, options FetchOptions) (string, error) {
 
 		// If initializing cache fails for some reason, ignore and let it be nil
 		fetchCache, cacheErr = cache.NewCache(options.CacheDir)
+		if fetchCache != nil {
+			fetchCache.MaxBytes = options.maxResponseBytes()
+		}
 
 		if options.VerboseOutput && cacheErr != nil {
 			fmt.Fprintf(os.Stderr, "Error initializing cache: %s\n", cacheErr.Error())
 		}
 	}
 
-	response, envkeyParam, pw, err := fetchEnv(envkey, options, fetchCache)
+	start := time.Now()
+	response, envkeyParam, pw, err := fetchEnv(envkey, options, fetchCache, metadata)
 	if err != nil {
-		return "", err
-	}
-
-	if options.VerboseOutput {
-		fmt.Fprintln(os.Stderr, "Parsing and decrypting response...")
-	}
-	res, err := response.Parse(pw)
-	if err != nil {
-		if options.VerboseOutput {
-			fmt.Fprintln(os.Stderr, "Error parsing and decrypting:")
-			fmt.Fprintln(os.Stderr, err)
-		}
-
-		if fetchCache != nil {
-			fetchCache.Delete(envkeyParam)
-		}
-		return "", errors.New("ENVKEY invalid")
-	}
-
-	// Ensure cache bizness finished (don't worry about error)
-	if fetchCache != nil {
-		select {
-		case <-fetchCache.Done:
-		default:
-		}
+		return nil, nil, "", "", err
 	}
+	metadata.Latency.Network = time.Since(start)
 
-	return res, nil
+	return response, fetchCache, envkeyParam, pw, nil
 }
 
 func UrlWithLoggingParams(baseUrl string, options FetchOptions) string {
@@ -146,26 +518,20 @@ func UrlWithLoggingParams(baseUrl string, options FetchOptions) string {
 	)
 }
 
+// InitHttpClient sets Client to a client with the default proxy and TLS
+// settings. Use NewHttpClient for others.
 func InitHttpClient(timeoutSeconds float64) {
-	to := time.Second * time.Duration(timeoutSeconds)
-	Client = &http.Client{
-		Timeout: to,
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout: time.Duration(timeoutSeconds) * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: time.Duration(timeoutSeconds) * time.Second,
-		},
-	}
+	// Without proxy or TLS options there's nothing to fail
+	Client, _ = NewHttpClient(FetchOptions{TimeoutSeconds: timeoutSeconds})
 }
 
 func httpExecRequest(
+	client *http.Client,
 	req *http.Request,
 	respChan chan httpChannelResponse,
 	errChan chan httpChannelErr,
 ) {
-	resp, err := Client.Do(req)
+	resp, err := client.Do(req)
 	if err == nil {
 		respChan <- httpChannelResponse{resp, req.URL.String()}
 	} else {
@@ -176,8 +542,14 @@ func httpExecRequest(
 				errChan <- httpChannelErr{multierror.Append(err, certPoolErr), req.URL.String()}
 				return
 			}
-			Client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: certPool}
-			httpExecRequest(req, respChan, errChan)
+			transport := client.Transport.(*http.Transport)
+			tlsConfig := &tls.Config{}
+			if transport.TLSClientConfig != nil {
+				tlsConfig = transport.TLSClientConfig.Clone()
+			}
+			tlsConfig.RootCAs = certPool
+			transport.TLSClientConfig = tlsConfig
+			httpExecRequest(client, req, respChan, errChan)
 		} else {
 			errChan <- httpChannelErr{err, req.URL.String()}
 		}
@@ -185,7 +557,9 @@ func httpExecRequest(
 }
 
 func httpGetAsync(
+	client *http.Client,
 	url string,
+	header http.Header,
 	ctx context.Context,
 	respChan chan httpChannelResponse,
 	errChan chan httpChannelErr,
@@ -197,15 +571,18 @@ func httpGetAsync(
 		return
 	}
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req = req.WithContext(ctx)
 
-	go httpExecRequest(req, respChan, errChan)
+	go httpExecRequest(client, req, respChan, errChan)
 }
 
-func httpGet(url string) (*http.Response, error) {
+func httpGet(client *http.Client, url string, header http.Header) (*http.Response, error) {
 	respChan, errChan := make(chan httpChannelResponse), make(chan httpChannelErr)
 
-	httpGetAsync(url, context.Background(), respChan, errChan)
+	httpGetAsync(client, url, header, context.Background(), respChan, errChan)
 
 	for {
 		select {
@@ -232,10 +609,11 @@ func logRequestIfVerbose(url string, options FetchOptions, err error, r *http.Re
 	}
 }
 
-func fetchEnv(envkey string, options FetchOptions, fetchCache *cache.Cache) (*parser.EnvServiceResponse, string, string, error) {
+func fetchEnv(envkey string, options FetchOptions, fetchCache *cache.Cache, metadata *Metadata) (*parser.EnvServiceResponse, string, string, error) {
 	envkeyParam, pw, envkeyHost := splitEnvkey(envkey)
 	response := new(parser.EnvServiceResponse)
-	err := getJson(envkeyHost, envkeyParam, options, response, fetchCache)
+	metadata.Attempts = 1
+	err := getJson(envkeyHost, envkeyParam, options, response, fetchCache, metadata)
 
 	if err != nil && options.Retries > 0 {
 		var retry uint8 = 0
@@ -251,7 +629,8 @@ func fetchEnv(envkey string, options FetchOptions, fetchCache *cache.Cache) (*pa
 			if options.VerboseOutput {
 				fmt.Fprintf(os.Stderr, "\nRetrying...\n")
 			}
-			err = getJson(envkeyHost, envkeyParam, options, response, fetchCache)
+			metadata.Attempts++
+			err = getJson(envkeyHost, envkeyParam, options, response, fetchCache, metadata)
 			if err == nil {
 				break
 			}
@@ -264,6 +643,60 @@ func fetchEnv(envkey string, options FetchOptions, fetchCache *cache.Cache) (*pa
 	return response, envkeyParam, pw, err
 }
 
+// readVerifiedLinks merges links persisted in the cache into the envkey's
+// in-process memo. The file is authenticated with a secret derived from the envkey's
+// passphrase, and is ignored if it's missing or fails authentication.
+func readVerifiedLinks(fetchCache *cache.Cache, envkeyParam, pw string, options FetchOptions) {
+	body, err := fetchCache.ReadLinks(envkeyParam)
+	if err != nil {
+		return
+	}
+
+	links, err := trust.UnmarshalVerifiedLinks(body, verifiedLinksSecret(pw))
+	if err != nil {
+		if options.VerboseOutput {
+			fmt.Fprintf(os.Stderr, "Ignoring cached verified links: %s\n", err.Error())
+		}
+		return
+	}
+	envkeyVerifiedLinks(envkeyParam).Merge(links)
+}
+
+func writeVerifiedLinks(fetchCache *cache.Cache, envkeyParam, pw string, options FetchOptions) {
+	body, err := envkeyVerifiedLinks(envkeyParam).MarshalSigned(verifiedLinksSecret(pw))
+	if err == nil {
+		err = fetchCache.WriteLinks(envkeyParam, body)
+	}
+	if err != nil && options.VerboseOutput {
+		fmt.Fprintf(os.Stderr, "Error caching verified links: %s\n", err.Error())
+	}
+}
+
+func verifiedLinksSecret(pw string) []byte {
+	secret := sha256.Sum256([]byte("envkey-fetch verified links:" + pw))
+	return secret[:]
+}
+
+func resolvePinnedRoots(envkey string, options FetchOptions) (trust.Pins, error) {
+	pinnedRoots := append(trust.Pins{}, options.PinnedRoots...)
+
+	if options.PinFile != "" {
+		pinFile, err := trust.ReadPinFile(options.PinFile)
+		if err != nil {
+			return nil, err
+		}
+
+		envkeyParam, _, _ := splitEnvkey(envkey)
+		pins, ok := pinFile[envkeyParam]
+		if !ok || len(pins) == 0 {
+			return nil, errors.New("No pinned roots for ENVKEY in " + options.PinFile)
+		}
+		pinnedRoots = append(pinnedRoots, pins...)
+	}
+
+	return pinnedRoots, nil
+}
+
 func splitEnvkey(envkey string) (string, string, string) {
 	split := strings.Split(envkey, "-")
 	var envkeyParam, pw, envkeyHost string
@@ -277,7 +710,7 @@ func splitEnvkey(envkey string) (string, string, string) {
 	return envkeyParam, pw, envkeyHost
 }
 
-func getBaseUrl(envkeyHost string, envkeyParam string) string {
+func getBaseUrl(envkeyHost string, envkeyParam string, options FetchOptions) string {
 	var host, protocol string
 	if envkeyHost == "" {
 		host = DefaultHost
@@ -293,26 +726,26 @@ func getBaseUrl(envkeyHost string, envkeyParam string) string {
 		protocol = "https://"
 	}
 
-	apiVersion := "v" + strconv.Itoa(ApiVersion)
+	apiVersion := "v" + strconv.Itoa(options.apiVersion())
 	return strings.Join([]string{protocol + host, apiVersion, envkeyParam}, "/")
 }
 
 func getJsonUrl(envkeyHost string, envkeyParam string, options FetchOptions) string {
-	baseUrl := getBaseUrl(envkeyHost, envkeyParam)
+	baseUrl := getBaseUrl(envkeyHost, envkeyParam, options)
 	return UrlWithLoggingParams(baseUrl, options)
 }
 
-func getBackupUrls(envkeyParam string) []string {
+func getBackupUrls(envkeyParam string, options FetchOptions) []string {
 	protocol := "https://"
-	apiVersion := strconv.Itoa(ApiVersion)
+	apiVersion := strconv.Itoa(options.apiVersion())
 	return []string{
 		strings.Join([]string{protocol + BackupHost, "v" + apiVersion, envkeyParam}, "/"),
 		fmt.Sprintf("%s?v=%s&id=%s", protocol+BackupHostRestricted, apiVersion, envkeyParam),
 	}
 }
 
-func fetchBackup(envkeyParam string, options FetchOptions) (*http.Response, error) {
-	backupUrls := getBackupUrls(envkeyParam)
+func fetchBackup(client *http.Client, envkeyParam string, options FetchOptions) (*http.Response, string, error) {
+	backupUrls := getBackupUrls(envkeyParam, options)
 
 	if options.VerboseOutput {
 		fmt.Fprintf(os.Stderr, "Attempting to load encrypted config from backup urls: %s\n", backupUrls)
@@ -326,7 +759,7 @@ func fetchBackup(envkeyParam string, options FetchOptions) (*http.Response, erro
 		ctx, cancel := context.WithCancel(context.Background())
 		urlWithParams := UrlWithLoggingParams(backupUrl, options)
 		cancelFnByUrl[urlWithParams] = cancel
-		httpGetAsync(urlWithParams, ctx, respChan, errChan)
+		httpGetAsync(client, urlWithParams, apiVersionsHeader(), ctx, respChan, errChan)
 	}
 
 	var err error
@@ -343,26 +776,33 @@ func fetchBackup(envkeyParam string, options FetchOptions) (*http.Response, erro
 				}
 			}
 
-			return channelResp.response, nil
+			return channelResp.response, channelResp.url, nil
 		case channelErr := <-errChan:
 			err = multierror.Append(err, channelErr.err)
 			numErrs++
 			if numErrs == len(backupUrls) {
 				logRequestIfVerbose(channelErr.url, options, channelErr.err, nil)
-				return nil, err
+				return nil, "", err
 			}
 		}
 	}
 }
 
-func getJson(envkeyHost string, envkeyParam string, options FetchOptions, response *parser.EnvServiceResponse, fetchCache *cache.Cache) error {
+func getJson(envkeyHost string, envkeyParam string, options FetchOptions, response *parser.EnvServiceResponse, fetchCache *cache.Cache, metadata *Metadata) error {
 	var err, fetchErr, backupFetchErr error
 	var body []byte
 	var r *http.Response
+	var negotiatedVersion int
+
+	client, err := httpClient(options)
+	if err != nil {
+		return err
+	}
 
 	url := getJsonUrl(envkeyHost, envkeyParam, options)
+	metadata.Source, metadata.Url = SourcePrimary, url
 
-	r, fetchErr = httpGet(url)
+	r, fetchErr = httpGet(client, url, apiVersionsHeader())
 	if r != nil {
 		defer r.Body.Close()
 	}
@@ -376,7 +816,9 @@ func getJson(envkeyHost string, envkeyParam string, options FetchOptions, respon
 		logRequestIfVerbose(url, options, fetchErr, r)
 
 		if envkeyHost == "" || envkeyHost == DefaultHost {
-			r, backupFetchErr = fetchBackup(envkeyParam, options)
+			var backupUrl string
+			r, backupUrl, backupFetchErr = fetchBackup(client, envkeyParam, options)
+			metadata.Source, metadata.Url = SourceBackup, backupUrl
 
 			if r != nil {
 				defer r.Body.Close()
@@ -385,7 +827,12 @@ func getJson(envkeyHost string, envkeyParam string, options FetchOptions, respon
 	}
 
 	if backupFetchErr == nil && (r != nil && r.StatusCode == 200) {
-		body, err = ioutil.ReadAll(r.Body)
+		negotiatedVersion, err = negotiatedApiVersion(r)
+		if err != nil {
+			return err
+		}
+
+		body, err = readBody(r, metadata.Url, options.maxResponseBytes())
 
 		if err != nil {
 			if options.VerboseOutput {
@@ -394,22 +841,27 @@ func getJson(envkeyHost string, envkeyParam string, options FetchOptions, respon
 			}
 			return err
 		}
-	} else if backupFetchErr != nil || (r != nil && r.StatusCode >= 400 && r.StatusCode != 404) {
+	} else if fetchErr != nil || backupFetchErr != nil || (r != nil && r.StatusCode >= 400 && r.StatusCode != 404) {
 		// try loading from cache
 		if fetchCache == nil {
-			if backupFetchErr == nil {
+			if backupFetchErr == nil && fetchErr != nil {
+				// a custom host without backups, e.g. refused by a TLS pin
+				return fmt.Errorf("could not load from server.\nfetch error: %w", fetchErr)
+			} else if backupFetchErr == nil {
 				return errors.New("could not load from server or s3 backup.")
 			} else {
-				return errors.New("could not load from server or s3 backup.\nfetch error: " + fetchErr.Error() + "\nbackup fetch error: " + backupFetchErr.Error())
+				return errors.New("could not load from server or s3 backup.\nfetch error: " + errString(fetchErr) + "\nbackup fetch error: " + errString(backupFetchErr))
 			}
 		} else {
+			metadata.Source, metadata.Url = SourceCache, ""
+			metadata.CacheAge, _ = fetchCache.Age(envkeyParam)
 			body, err = fetchCache.Read(envkeyParam)
 			if err != nil {
 				if options.VerboseOutput {
 					fmt.Fprintln(os.Stderr, "Cache read error:")
 					fmt.Fprintln(os.Stderr, err)
 				}
-				return errors.New("could not load from server, s3 backup, or cache.\nfetch error: " + fetchErr.Error() + "\nbackup fetch error: " + backupFetchErr.Error() + "\ncache read error: " + err.Error())
+				return fmt.Errorf("could not load from server, s3 backup, or cache.\nfetch error: %s\nbackup fetch error: %s\ncache read error: %w", errString(fetchErr), errString(backupFetchErr), err)
 			}
 		}
 
@@ -426,11 +878,116 @@ func getJson(envkeyHost string, envkeyParam string, options FetchOptions, respon
 		return errors.New("ENVKEY invalid")
 	}
 
-	err = json.Unmarshal(body, response)
+	decoded, version, err := parser.DecodeResponse(body, parser.DecodeOptions{
+		DisallowUnknownFields: options.StrictDecode,
+		ApiVersion:            negotiatedVersion,
+	})
+	if err != nil {
+		return err
+	}
+	*response = *decoded
+	metadata.ApiVersion = version
+
 	if fetchCache != nil && response.AllowCaching {
+		// A cached response has no headers, so if the version was only
+		// negotiated, cache the response in a form that declares it
+		if declared, _ := parser.ResponseApiVersion(body); declared == 0 && version != parser.DefaultApiVersion {
+			body, err = parser.EncodeResponse(response, version)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Drop the result of a cache read above, so Done next receives the
+		// write's
+		select {
+		case <-fetchCache.Done:
+		default:
+		}
+
 		// If caching enabled, write raw response to cache while doing decryption in parallel
 		go fetchCache.Write(envkeyParam, body)
 	}
 
-	return err
+	return nil
+}
+
+func (options FetchOptions) maxResponseBytes() int64 {
+	if options.MaxResponseBytes > 0 {
+		return options.MaxResponseBytes
+	}
+	return DefaultMaxResponseBytes
+}
+
+// readBody reads at most limit bytes of a response body, after checking its
+// declared Content-Type and Content-Length.
+func readBody(r *http.Response, url string, limit int64) ([]byte, error) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !(jsonContentTypes[mediaType] || strings.HasSuffix(mediaType, "+json")) {
+			return nil, &ContentTypeError{url, contentType}
+		}
+	}
+
+	// Use the header rather than r.ContentLength, which can't distinguish an
+	// empty body from a missing header in all transports
+	contentLength := r.Header.Get("Content-Length")
+	declared := int64(-1)
+	if contentLength != "" {
+		var err error
+		declared, err = strconv.ParseInt(contentLength, 10, 64)
+		if err != nil || declared < 0 {
+			return nil, &ContentLengthError{url, contentLength, -1}
+		} else if declared > limit {
+			return nil, &ResponseTooLargeError{url, limit}
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, &ResponseTooLargeError{url, limit}
+	}
+	if declared >= 0 && int64(len(body)) != declared {
+		return nil, &ContentLengthError{url, contentLength, int64(len(body))}
+	}
+	return body, nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "none"
+	}
+	return err.Error()
+}
+
+func (options FetchOptions) apiVersion() int {
+	if options.ApiVersion > 0 {
+		return options.ApiVersion
+	}
+	return ApiVersion
+}
+
+func apiVersionsHeader() http.Header {
+	var versions []string
+	for _, version := range parser.SupportedApiVersions() {
+		versions = append(versions, strconv.Itoa(version))
+	}
+	return http.Header{AcceptApiVersionsHeader: {strings.Join(versions, ", ")}}
+}
+
+// negotiatedApiVersion returns the version a server chose in ApiVersionHeader,
+// or 0 if it didn't send the header.
+func negotiatedApiVersion(r *http.Response) (int, error) {
+	header := r.Header.Get(ApiVersionHeader)
+	if header == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || version < 1 {
+		return 0, &parser.DecodeError{Err: fmt.Errorf("invalid %s header %q.", ApiVersionHeader, header)}
+	}
+	return version, nil
 }
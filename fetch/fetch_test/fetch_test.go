@@ -1,14 +1,34 @@
 package fetch_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/envkey/envkey-fetch/cache"
+	"github.com/envkey/envkey-fetch/envkeytest"
 	"github.com/envkey/envkey-fetch/fetch"
+	"github.com/envkey/envkey-fetch/parser"
+	"github.com/envkey/envkey-fetch/trust"
 	"github.com/envkey/envkey-fetch/version"
 	httpmock "gopkg.in/jarcoal/httpmock.v1"
 
@@ -79,7 +99,7 @@ func TestFetch(t *testing.T) {
 	httpmock.ActivateNonDefault(fetch.Client)
 	defer httpmock.DeactivateAndReset()
 
-	opts := fetch.FetchOptions{true, "", "envkey-fetch", version.Version, false, 2.0, 1, 0.1}
+	opts := fetch.FetchOptions{ShouldCache: true, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
 
 	// Caching enabled
 	for _, test := range fetchTests {
@@ -118,7 +138,7 @@ func TestFetch(t *testing.T) {
 			assert.NotNil(err, "Should not cache the response.")
 		}
 
-		res, err = fetch.Fetch(test.envkey, fetch.FetchOptions{false, "", "envkey-fetch", version.Version, false, 2.0, 1, 0.1})
+		res, err = fetch.Fetch(test.envkey, fetch.FetchOptions{ShouldCache: false, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1})
 
 		// With caching disabled
 		if test.expectErr {
@@ -137,7 +157,7 @@ func TestFetch(t *testing.T) {
 		t.Run("failed requests should retry", func(t *testing.T) {
 			const retries = 3
 			const backoff = 0.1
-			opts := fetch.FetchOptions{true, "", "envkey-fetch", version.Version, false, 2.0, retries, backoff}
+			opts := fetch.FetchOptions{ShouldCache: true, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: retries, RetryBackoff: backoff}
 			responder := httpmock.NewStringResponder(test.responseStatus, test.response)
 			callCount := 0
 			httpmock.RegisterResponder(
@@ -159,6 +179,943 @@ func TestFetch(t *testing.T) {
 	}
 }
 
+func TestFetchConfig(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	opts := fetch.FetchOptions{ShouldCache: false, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	url := fetch.UrlWithLoggingParams("https://"+fetch.DefaultHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, responseSimple))
+
+	c, err := fetch.FetchConfig(validEnvkeySimple, opts)
+	assert.Nil(err)
+	assert.Equal("it", c.MustGet("GO_TEST"))
+	assert.Equal("works!", c.MustGet("GO_TEST_2"))
+
+	_, err = fetch.FetchConfig(invalidEnvkey, opts)
+	assert.NotNil(err)
+
+	_, err = fetch.FetchConfig("validkey-wrongpassphrase", opts)
+	assert.Equal(fetch.ErrWrongPassphrase, err, "Should return a distinct wrong passphrase error.")
+}
+
+func TestFetchPinnedRoots(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	opts := fetch.FetchOptions{ShouldCache: false, ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	url := fetch.UrlWithLoggingParams("https://"+fetch.DefaultHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, responseSimple))
+
+	opts.PinnedRoots = trust.Pins{{Id: "not-the-root", Fingerprint: "0000000000000000000000000000000000000000"}}
+	_, err := fetch.Fetch(validEnvkeySimple, opts)
+	assert.Equal(fetch.ErrRootNotPinned, err, "Should return a distinct pinning error.")
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-pins")
+	defer os.RemoveAll(dir)
+	pinFile := filepath.Join(dir, "pins.json")
+	ioutil.WriteFile(pinFile, []byte(`{"some-other-envkey": [{"id": "root", "fingerprint": "00"}]}`), 0600)
+
+	opts.PinnedRoots = nil
+	opts.PinFile = pinFile
+	_, err = fetch.Fetch(validEnvkeySimple, opts)
+	assert.NotNil(err, "Should require pins for the envkey when a pin file is given.")
+}
+
+func TestFetchExplain(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	opts := fetch.FetchOptions{ShouldCache: false, ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	url := fetch.UrlWithLoggingParams("https://"+fetch.DefaultHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, responseSimple))
+
+	res, err := fetch.FetchWithMetadata(validEnvkeySimple, opts)
+	assert.Nil(err, "Should not return an error.")
+	assert.Nil(res.Metadata.TrustChain, "Should only explain when asked.")
+
+	opts.Explain = true
+	res, err = fetch.FetchWithMetadata(validEnvkeySimple, opts)
+	assert.Nil(err, "Should not return an error.")
+	if assert.Len(res.Metadata.TrustChain, 1, "Should explain the signer's trust chain.") {
+		assert.True(res.Metadata.TrustChain[0].Trusted)
+		assert.Equal(res.Metadata.SignerId, res.Metadata.TrustChain[0].SignerId)
+	}
+
+	opts.PinnedRoots = trust.Pins{{Id: "not-the-root", Fingerprint: "0000000000000000000000000000000000000000"}}
+	_, err = fetch.FetchWithMetadata(validEnvkeySimple, opts)
+	assert.ErrorIs(err, fetch.ErrRootNotPinned, "Should return a distinct pinning error.")
+	var explainedErr *trust.ExplainedError
+	if assert.ErrorAs(err, &explainedErr, "Should explain the failure.") {
+		assert.False(explainedErr.Explanation.Trusted)
+		assert.NotEqual("", explainedErr.Explanation.BrokenAt, "Should record where the chain broke.")
+	}
+}
+
+func TestFetchVerifiedLinks(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-links")
+	defer os.RemoveAll(dir)
+
+	opts := fetch.FetchOptions{ShouldCache: true, CacheDir: dir, ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	url := fetch.UrlWithLoggingParams("https://"+fetch.DefaultHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, responseSimple))
+
+	res, err := fetch.Fetch(validEnvkeySimple, opts)
+	assert.Nil(err, "Should not return an error.")
+	assert.Equal(validResult, res, "Should return the decrypted config.")
+
+	linksPath := filepath.Join(dir, "validkey.links")
+	_, err = os.Stat(linksPath)
+	assert.Nil(err, "Should persist verified links alongside the cache.")
+
+	ioutil.WriteFile(linksPath, []byte(`{"links":{},"mac":"00"}`), 0600)
+	res, err = fetch.Fetch(validEnvkeySimple, opts)
+	assert.Nil(err, "Should ignore links that fail authentication.")
+	assert.Equal(validResult, res, "Should return the decrypted config.")
+}
+
+func TestFetchVerifiedLinksPerEnvkey(t *testing.T) {
+	assert := assert.New(t)
+
+	server := envkeytest.NewServer()
+	defer server.Close()
+	invited, err := envkeytest.NewFixture(envkeytest.FixtureOptions{
+		Host:         server.Host,
+		Keyables:     []envkeytest.Keyable{{Id: "owner"}, {Id: "admin", InvitedBy: "owner"}},
+		AllowCaching: true,
+	})
+	if !assert.Nil(err) {
+		return
+	}
+	root, err := envkeytest.NewFixture(envkeytest.FixtureOptions{Host: server.Host, AllowCaching: true})
+	if !assert.Nil(err) {
+		return
+	}
+	server.AddResponse(invited.Id, invited.Response)
+	server.AddResponse(root.Id, root.Response)
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-links")
+	defer os.RemoveAll(dir)
+
+	fetch.InitHttpClient(2.0)
+	opts := fetch.FetchOptions{ShouldCache: true, CacheDir: dir, TimeoutSeconds: 2.0}
+	persisted := func(id string) map[string]json.RawMessage {
+		var signed struct {
+			Links map[string]json.RawMessage `json:"links"`
+		}
+		body, _ := ioutil.ReadFile(filepath.Join(dir, id+".links"))
+		json.Unmarshal(body, &signed)
+		return signed.Links
+	}
+
+	_, err = fetch.Fetch(invited.Envkey, opts)
+	assert.Nil(err)
+	_, err = fetch.Fetch(root.Envkey, opts)
+	assert.Nil(err)
+	assert.Len(persisted(invited.Id), 1, "Should persist the invitation verified for the envkey.")
+	assert.Len(persisted(root.Id), 0, "Should not persist links verified for another envkey.")
+}
+
+func TestFetchTrustGraph(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	opts := fetch.FetchOptions{ShouldCache: false, ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	url := fetch.UrlWithLoggingParams("https://"+fetch.DefaultHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, responseSimple))
+
+	graph, err := fetch.FetchTrustGraph(validEnvkeySimple, opts)
+	assert.Nil(err, "Should not return an error.")
+	if assert.NotNil(graph) {
+		assert.NotEmpty(graph.Nodes, "Should include the trusted keys.")
+		var signers int
+		for _, node := range graph.Nodes {
+			if node.Signer {
+				signers++
+				assert.True(node.Trusted, "Should verify the signer.")
+			}
+		}
+		assert.Equal(1, signers, "Should mark the signer.")
+	}
+
+	_, err = fetch.FetchTrustGraph(strings.Replace(validEnvkeySimple, "-", "-wrong", 1), opts)
+	assert.NotNil(err, "Should return an error.")
+}
+
+func TestFetchCacheVerifiedAtNow(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-cache")
+	defer os.RemoveAll(dir)
+
+	// Keys didn't exist yet long ago, but anyone who can write to the cache
+	// can backdate it, so the fallback is verified as of now regardless
+	path := filepath.Join(dir, "validkey")
+	ioutil.WriteFile(path, []byte(responseSimple), 0600)
+	longAgo := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(path, longAgo, longAgo)
+
+	opts := fetch.FetchOptions{ShouldCache: true, CacheDir: dir, ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	res, err := fetch.FetchWithMetadata(validEnvkeySimple, opts)
+	if assert.Nil(err, "Should verify the cached response as of now.") {
+		assert.Equal(fetch.SourceCache, res.Metadata.Source)
+		assert.Equal(validResult, res.Env)
+	}
+}
+
+func TestFetchWithMetadata(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	opts := fetch.FetchOptions{ShouldCache: false, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
+	url := fetch.UrlWithLoggingParams("https://"+fetch.DefaultHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/inheritanceoverrides", opts)
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, responseInheritanceOverrides))
+
+	res, err := fetch.FetchWithMetadata(validEnvkeyInheritanceOverrides, opts)
+	assert.Nil(err)
+	assert.Equal(validResultInheritanceOverrides, res.Env)
+	assert.Equal(fetch.SourcePrimary, res.Metadata.Source)
+	assert.Equal(url, res.Metadata.Url)
+	assert.Equal(1, res.Metadata.Attempts)
+	assert.NotEmpty(res.Metadata.SignerId)
+	assert.True(res.Metadata.InheritanceOverridesApplied)
+	assert.True(res.Metadata.Latency.Decryption > 0)
+
+	envelope, err := json.Marshal(res)
+	assert.Nil(err)
+	assert.Contains(string(envelope), `"env":`+validResultInheritanceOverrides)
+	assert.Contains(string(envelope), `"source":"primary"`)
+	assert.NotContains(string(envelope), "cacheAgeMs")
+}
+
+func TestFetchResponseLimits(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	envkey := validEnvkeySimple + "-" + customRemoteHost
+	opts := fetch.FetchOptions{ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0}
+	url := fetch.UrlWithLoggingParams("https://"+customRemoteHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+
+	respond := func(body string, headers map[string]string) {
+		httpmock.RegisterResponder("GET", url, func(req *http.Request) (*http.Response, error) {
+			res := httpmock.NewStringResponse(http.StatusOK, body)
+			for k, v := range headers {
+				res.Header.Set(k, v)
+			}
+			return res, nil
+		})
+	}
+
+	var tooLarge *fetch.ResponseTooLargeError
+	var contentLength *fetch.ContentLengthError
+	var contentType *fetch.ContentTypeError
+	var decodeErr *parser.DecodeError
+
+	respond(responseSimple, map[string]string{"Content-Type": "application/json; charset=utf-8", "Content-Length": strconv.Itoa(len(responseSimple))})
+	res, err := fetch.Fetch(envkey, opts)
+	assert.Nil(err, "Should accept a well formed response.")
+	assert.Equal(validResult, res)
+
+	limited := opts
+	limited.MaxResponseBytes = 100
+	respond(responseSimple, nil)
+	_, err = fetch.Fetch(envkey, limited)
+	if assert.ErrorAs(err, &tooLarge, "Should limit the body.") {
+		assert.Equal(int64(100), tooLarge.Limit)
+	}
+
+	respond(responseSimple, map[string]string{"Content-Length": "1000000000"})
+	_, err = fetch.Fetch(envkey, opts)
+	assert.ErrorAs(err, &tooLarge, "Should reject a declared size over the limit.")
+
+	respond(responseSimple, map[string]string{"Content-Length": "5"})
+	_, err = fetch.Fetch(envkey, opts)
+	if assert.ErrorAs(err, &contentLength, "Should reject a mismatched Content-Length.") {
+		assert.Equal(int64(len(responseSimple)), contentLength.Read)
+	}
+
+	respond(responseSimple, map[string]string{"Content-Length": "-1"})
+	_, err = fetch.Fetch(envkey, opts)
+	assert.ErrorAs(err, &contentLength, "Should reject an invalid Content-Length.")
+
+	respond("<html>proxy error</html>", map[string]string{"Content-Type": "text/html"})
+	_, err = fetch.Fetch(envkey, opts)
+	if assert.ErrorAs(err, &contentType, "Should reject html.") {
+		assert.Equal("text/html", contentType.ContentType)
+	}
+
+	withUnknown := strings.Replace(responseSimple, "{", `{"unknown_field":1,`, 1)
+	respond(withUnknown, nil)
+	_, err = fetch.Fetch(envkey, opts)
+	assert.Nil(err, "Should ignore unknown fields by default.")
+
+	strict := opts
+	strict.StrictDecode = true
+	_, err = fetch.Fetch(envkey, strict)
+	assert.ErrorAs(err, &decodeErr, "Should reject unknown fields when strict.")
+
+	respond(responseSimple+"garbage", nil)
+	_, err = fetch.Fetch(envkey, opts)
+	assert.ErrorAs(err, &decodeErr, "Should reject trailing data.")
+}
+
+func TestFetchApiVersions(t *testing.T) {
+	assert := assert.New(t)
+	fetch.InitHttpClient(2.0)
+	httpmock.ActivateNonDefault(fetch.Client)
+	defer httpmock.DeactivateAndReset()
+
+	cacheDir, _ := ioutil.TempDir("", "envkey-fetch-versions")
+	defer os.RemoveAll(cacheDir)
+
+	envkey := validEnvkeySimple + "-" + customRemoteHost
+	opts := fetch.FetchOptions{ShouldCache: true, CacheDir: cacheDir, ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0}
+	url := fetch.UrlWithLoggingParams("https://"+customRemoteHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
+
+	var accepted string
+	respond := func(url, body, negotiated string) {
+		httpmock.RegisterResponder("GET", url, func(req *http.Request) (*http.Response, error) {
+			accepted = req.Header.Get(fetch.AcceptApiVersionsHeader)
+			res := httpmock.NewStringResponse(http.StatusOK, body)
+			if negotiated != "" {
+				res.Header.Set(fetch.ApiVersionHeader, negotiated)
+			}
+			return res, nil
+		})
+	}
+
+	fetchCache, _ := cache.NewCache(cacheDir)
+	cached := func() string {
+		var body []byte
+		assert.Eventually(func() bool {
+			var err error
+			body, err = fetchCache.Read("validkey")
+			return err == nil
+		}, time.Second, 10*time.Millisecond, "Should cache the response.")
+		fetchCache.Delete("validkey")
+		return string(body)
+	}
+
+	respond(url, responseSimple, "")
+	res, err := fetch.FetchWithMetadata(envkey, opts)
+	assert.Nil(err)
+	assert.Equal("1", accepted, "Should only accept specified versions by default.")
+	assert.Equal(validResult, res.Env)
+	assert.Equal(1, res.Metadata.ApiVersion)
+	assert.Equal(responseSimple, cached(), "Should cache a v1 response as served.")
+
+	parser.EnableExperimentalApiVersions()
+	var simple parser.EnvServiceResponse
+	json.Unmarshal([]byte(responseSimple), &simple)
+	v2, _ := parser.EncodeResponse(&simple, 2)
+	var v2Fields map[string]interface{}
+	json.Unmarshal(v2, &v2Fields)
+	delete(v2Fields, "api_version")
+	v2Undeclared, _ := json.Marshal(v2Fields)
+
+	respond(url, string(v2Undeclared), "2")
+	res, err = fetch.FetchWithMetadata(envkey, opts)
+	assert.Nil(err, "Should decode a v2 response negotiated by header.")
+	assert.Equal("2, 1", accepted, "Should accept experimental versions once enabled.")
+	assert.Equal(validResult, res.Env)
+	assert.Equal(2, res.Metadata.ApiVersion)
+	declared, _ := parser.ResponseApiVersion([]byte(cached()))
+	assert.Equal(2, declared, "Should cache a negotiated response with its version declared.")
+
+	respond(url, string(v2), "")
+	res, err = fetch.FetchWithMetadata(envkey, opts)
+	assert.Nil(err, "Should decode a v2 response that declares its version.")
+	assert.Equal(2, res.Metadata.ApiVersion)
+	assert.Equal(string(v2), cached())
+
+	var decodeErr *parser.DecodeError
+	var unsupported *parser.UnsupportedVersionError
+
+	respond(url, responseSimple, "two")
+	_, err = fetch.Fetch(envkey, opts)
+	assert.ErrorAs(err, &decodeErr, "Should reject an invalid version header.")
+
+	respond(url, responseSimple, "3")
+	_, err = fetch.Fetch(envkey, opts)
+	if assert.ErrorAs(err, &unsupported, "Should reject an unsupported version.") {
+		assert.Equal(3, unsupported.Version)
+	}
+
+	respond(url, string(v2), "1")
+	_, err = fetch.Fetch(envkey, opts)
+	assert.ErrorAs(err, &decodeErr, "Should reject a response declaring a different version than negotiated.")
+
+	v2Opts := opts
+	v2Opts.ShouldCache = false
+	v2Opts.ApiVersion = 2
+	v2Url := fetch.UrlWithLoggingParams("https://"+customRemoteHost+"/v2/validkey", v2Opts)
+	respond(v2Url, string(v2), "")
+	res, err = fetch.FetchWithMetadata(envkey, v2Opts)
+	assert.Nil(err, "Should request the configured version.")
+	assert.Equal(v2Url, res.Metadata.Url)
+	assert.Equal(2, res.Metadata.ApiVersion)
+}
+
+func TestMockServer(t *testing.T) {
+	assert := assert.New(t)
+	server := envkeytest.NewServer()
+	defer server.Close()
+	assert.Nil(server.AddResponseJson("validkey", []byte(responseSimple)))
+
+	fetch.Client = server.Client()
+	defer fetch.InitHttpClient(2.0)
+
+	envkey := server.Envkey("validkey", "r8KJZJSNNjnaiyXu")
+	opts := fetch.FetchOptions{ClientName: "envkey-fetch", ClientVersion: version.Version, TimeoutSeconds: 2.0}
+
+	res, err := fetch.FetchWithMetadata(envkey, opts)
+	assert.Nil(err)
+	assert.Equal(validResult, res.Env)
+	assert.Equal(fetch.SourcePrimary, res.Metadata.Source)
+
+	retrying := opts
+	retrying.Retries = 2
+	server.SetFaults(envkeytest.Faults{ServerErrors: 2})
+	res, err = fetch.FetchWithMetadata(envkey, retrying)
+	assert.Nil(err, "Should recover from server errors by retrying.")
+	assert.Equal(3, res.Metadata.Attempts)
+
+	server.SetFaults(envkeytest.Faults{NotFound: true})
+	_, err = fetch.Fetch(envkey, opts)
+	assert.EqualError(err, "ENVKEY invalid")
+
+	server.SetFaults(envkeytest.Faults{BadSignature: true})
+	_, err = fetch.Fetch(envkey, opts)
+	assert.EqualError(err, "ENVKEY invalid", "Should reject a bad signature.")
+
+	server.SetFaults(envkeytest.Faults{Truncate: true})
+	_, err = fetch.Fetch(envkey, opts)
+	assert.NotNil(err, "Should reject a truncated body.")
+
+	server.SetFaults(envkeytest.Faults{Latency: time.Second})
+	fetch.Client.Timeout = 100 * time.Millisecond
+	_, err = fetch.Fetch(envkey, opts)
+	assert.NotNil(err, "Should time out.")
+	fetch.Client.Timeout = 0
+
+	defaultHost, backupHost, backupHostRestricted := fetch.DefaultHost, fetch.BackupHost, fetch.BackupHostRestricted
+	defer func() {
+		fetch.DefaultHost, fetch.BackupHost, fetch.BackupHostRestricted = defaultHost, backupHost, backupHostRestricted
+	}()
+	fetch.DefaultHost, fetch.BackupHost, fetch.BackupHostRestricted = server.Host, server.BackupHost(), server.BackupHostRestricted()
+
+	server.SetFaults(envkeytest.Faults{ServerErrors: -1, Routes: []envkeytest.Route{envkeytest.RoutePrimary}})
+	res, err = fetch.FetchWithMetadata(validEnvkeySimple, opts)
+	assert.Nil(err, "Should fall back to the backup hosts.")
+	assert.Equal(validResult, res.Env)
+	assert.Equal(fetch.SourceBackup, res.Metadata.Source)
+}
+
+func TestDecryptFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-decrypt")
+	defer os.RemoveAll(dir)
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(body), 0600)
+		return path
+	}
+
+	simple := write("simple.json", responseSimple)
+	opts := fetch.FetchOptions{}
+
+	res, err := fetch.DecryptFile(validEnvkeySimple, simple, time.Time{}, opts)
+	assert.Nil(err)
+	assert.Equal(validResult, res.Env)
+	assert.Equal(fetch.SourceFile, res.Metadata.Source)
+	assert.Equal(simple, res.Metadata.File)
+	assert.Equal(1, res.Metadata.ApiVersion)
+	assert.NotEmpty(res.Metadata.SignerId)
+
+	res, err = fetch.DecryptFile(validEnvkeyInheritanceOverrides, write("overrides.json", responseInheritanceOverrides), time.Time{}, opts)
+	assert.Nil(err)
+	assert.Equal(validResultInheritanceOverrides, res.Env)
+	assert.True(res.Metadata.InheritanceOverridesApplied)
+
+	_, err = fetch.DecryptFile("validkey-wrong", simple, time.Time{}, opts)
+	assert.Equal(fetch.ErrWrongPassphrase, err)
+
+	pinned := opts
+	pinned.PinnedRoots = trust.Pins{{Id: "not-the-root", Fingerprint: "0000000000000000000000000000000000000000"}}
+	_, err = fetch.DecryptFile(validEnvkeySimple, simple, time.Time{}, pinned)
+	assert.Equal(fetch.ErrRootNotPinned, err, "Should verify pinned roots.")
+
+	explained := opts
+	explained.Explain = true
+	res, err = fetch.DecryptFile(validEnvkeySimple, simple, time.Time{}, explained)
+	assert.Nil(err)
+	assert.Len(res.Metadata.TrustChain, 1)
+
+	// Keys didn't exist yet long ago, but a file's modification time is
+	// easily set, so it's only verified at a past time when asked to
+	old := write("old.json", responseSimple)
+	longAgo := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(old, longAgo, longAgo)
+	_, err = fetch.DecryptFile(validEnvkeySimple, old, time.Time{}, opts)
+	assert.Nil(err, "Should verify as of now.")
+	_, err = fetch.DecryptFile(validEnvkeySimple, old, longAgo, opts)
+	assert.NotNil(err, "Should verify as of the given time.")
+
+	limited := opts
+	limited.MaxResponseBytes = 100
+	_, err = fetch.DecryptFile(validEnvkeySimple, simple, time.Time{}, limited)
+	var tooLarge *fetch.ResponseTooLargeError
+	assert.ErrorAs(err, &tooLarge)
+
+	strict := opts
+	strict.StrictDecode = true
+	unknown := write("unknown.json", strings.Replace(responseSimple, "{", `{"unknown_field":1,`, 1))
+	_, err = fetch.DecryptFile(validEnvkeySimple, unknown, time.Time{}, strict)
+	var decodeErr *parser.DecodeError
+	assert.ErrorAs(err, &decodeErr)
+
+	var response parser.EnvServiceResponse
+	json.Unmarshal([]byte(responseSimple), &response)
+	parser.EnableExperimentalApiVersions()
+	v2, _ := parser.EncodeResponse(&response, 2)
+	res, err = fetch.DecryptResponse(validEnvkeySimple, v2, time.Time{}, opts)
+	assert.Nil(err, "Should decode the version a response declares.")
+	assert.Equal(2, res.Metadata.ApiVersion)
+	assert.Equal("", res.Metadata.File)
+
+	_, err = fetch.DecryptFile(validEnvkeySimple, filepath.Join(dir, "missing.json"), time.Time{}, opts)
+	assert.True(os.IsNotExist(err))
+
+	_, err = fetch.DecryptResponse("invalid", []byte(responseSimple), time.Time{}, opts)
+	assert.EqualError(err, "ENVKEY invalid")
+}
+
+func TestSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	parser.EnableExperimentalApiVersions()
+
+	server := envkeytest.NewServer()
+	defer server.Close()
+	fixture, err := envkeytest.NewFixture(envkeytest.FixtureOptions{Env: `{"A":"1"}`, Host: server.Host})
+	if !assert.Nil(err) {
+		return
+	}
+	server.AddResponse(fixture.Id, fixture.Response)
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-snapshot")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.envkey-snapshot")
+
+	fetch.InitHttpClient(2.0)
+	opts := fetch.FetchOptions{TimeoutSeconds: 2.0, ApiVersion: 2}
+	snapshot, err := fetch.FetchSnapshot(fixture.Envkey, opts)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(fixture.Id, snapshot.Id)
+	assert.Equal(fetch.SourcePrimary, snapshot.Source)
+	assert.Equal(2, snapshot.ApiVersion)
+	assert.Equal(version.Version, snapshot.EnvkeyFetchVersion)
+	assert.Nil(snapshot.WriteFile(path))
+
+	data, _ := ioutil.ReadFile(path)
+	assert.NotContains(string(data), `\"A\"`, "Should never store plaintext.")
+	info, _ := os.Stat(path)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// Decrypting the snapshot doesn't touch the server
+	server.SetFaults(envkeytest.Faults{ServerErrors: -1})
+	requests := len(server.Requests())
+
+	fromSnapshot := opts
+	fromSnapshot.Snapshot = path
+	res, err := fetch.FetchWithMetadata(fixture.Envkey, fromSnapshot)
+	if assert.Nil(err) {
+		assert.Equal(`{"A":"1"}`, res.Env)
+		assert.Equal(fetch.SourceSnapshot, res.Metadata.Source)
+		assert.Equal(path, res.Metadata.File)
+		assert.Equal(2, res.Metadata.ApiVersion)
+		metadataJson, _ := json.Marshal(res.Metadata)
+		assert.Contains(string(metadataJson), `"snapshotAgeMs"`)
+	}
+	assert.Len(server.Requests(), requests)
+
+	fresh := fromSnapshot
+	fresh.SnapshotMaxAge = time.Hour
+	_, err = fetch.FetchWithMetadata(fixture.Envkey, fresh)
+	assert.Nil(err)
+
+	stale := fromSnapshot
+	stale.SnapshotMaxAge = time.Nanosecond
+	_, err = fetch.FetchWithMetadata(fixture.Envkey, stale)
+	var tooOld *fetch.SnapshotTooOldError
+	if assert.ErrorAs(err, &tooOld) {
+		assert.Equal(path, tooOld.Path)
+	}
+
+	// Moving fetchedAt forward to get around the max age breaks the MAC
+	tampered := *snapshot
+	tampered.FetchedAt = time.Now().Add(30 * 24 * time.Hour)
+	tamperedPath := filepath.Join(dir, "tampered.envkey-snapshot")
+	tampered.WriteFile(tamperedPath)
+	fresh.Snapshot = tamperedPath
+	_, err = fetch.FetchWithMetadata(fixture.Envkey, fresh)
+	assert.Equal(fetch.ErrSnapshotMac, err)
+
+	unsigned := *snapshot
+	unsigned.Mac = ""
+	unsignedPath := filepath.Join(dir, "unsigned.envkey-snapshot")
+	unsigned.WriteFile(unsignedPath)
+	fresh.Snapshot = unsignedPath
+	_, err = fetch.FetchWithMetadata(fixture.Envkey, fresh)
+	assert.Equal(fetch.ErrSnapshotMac, err)
+
+	_, err = fetch.FetchWithMetadata(strings.Replace(fixture.Envkey, fixture.Id, "otherid", 1), fromSnapshot)
+	assert.Equal(fetch.ErrSnapshotEnvkey, err)
+
+	_, err = fetch.FetchWithMetadata(strings.Replace(fixture.Envkey, fixture.Passphrase, "wrong", 1), fromSnapshot)
+	assert.Equal(fetch.ErrSnapshotMac, err)
+
+	invalid := filepath.Join(dir, "invalid.envkey-snapshot")
+	ioutil.WriteFile(invalid, []byte(`{"format":99}`), 0600)
+	_, err = fetch.ReadSnapshot(invalid, fetch.DefaultMaxResponseBytes)
+	assert.NotNil(err, "Should reject unknown formats.")
+
+	server.SetFaults(envkeytest.Faults{BadSignature: true})
+	_, err = fetch.FetchSnapshot(fixture.Envkey, opts)
+	assert.NotNil(err, "Should verify before snapshotting.")
+}
+
+// writeClientCert writes a self-signed client certificate and its key to dir.
+func writeClientCert(dir string) (*x509.Certificate, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "envkey-fetch-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, certFile, keyFile
+}
+
+func pipe(a, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// connectProxy is an http proxy that tunnels CONNECT requests, counting them.
+func connectProxy(count *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(count, 1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, upstream)
+	}))
+}
+
+// socks5Proxy accepts unauthenticated socks5 CONNECT requests and connects
+// them all to target, counting them.
+func socks5Proxy(target string, count *int32) net.Listener {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 256)
+				// version and methods, then version, command, reserved and address type
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+					return
+				}
+				addrLen := 4
+				switch buf[3] {
+				case 3:
+					if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+						return
+					}
+					addrLen = int(buf[0])
+				case 4:
+					addrLen = 16
+				}
+				if _, err := io.ReadFull(conn, buf[:addrLen+2]); err != nil {
+					return
+				}
+
+				atomic.AddInt32(count, 1)
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(conn, upstream)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-transport")
+	defer os.RemoveAll(dir)
+	clientCert, certFile, keyFile := writeClientCert(dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	// A self-hosted EnvKey behind a private CA, requiring client certificates
+	handler := envkeytest.NewHandler()
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	fixture, err := envkeytest.NewFixture(envkeytest.FixtureOptions{Env: `{"A":"1"}`, Host: host})
+	if !assert.Nil(err) {
+		return
+	}
+	handler.AddResponse(fixture.Id, fixture.Response)
+
+	get := func(options fetch.FetchOptions) error {
+		options.TimeoutSeconds = 2.0
+		client, err := fetch.NewHttpClient(options)
+		if err != nil {
+			return err
+		}
+		res, err := client.Get("https://" + host + "/v1/" + fixture.Id)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", res.StatusCode)
+		}
+		return nil
+	}
+
+	assert.NotNil(get(fetch.FetchOptions{ClientCertFile: certFile, ClientKeyFile: keyFile}), "Should not trust the private CA by default.")
+	assert.NotNil(get(fetch.FetchOptions{CAFile: caFile}), "Should require a client certificate.")
+	mtls := fetch.FetchOptions{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile}
+	assert.Nil(get(mtls))
+
+	var connects, socksConnects int32
+	httpProxy := connectProxy(&connects)
+	defer httpProxy.Close()
+	socks := socks5Proxy(host, &socksConnects)
+	defer socks.Close()
+
+	viaHttp := mtls
+	viaHttp.Proxy = httpProxy.URL
+	assert.Nil(get(viaHttp))
+	assert.Equal(int32(1), atomic.LoadInt32(&connects))
+
+	viaSocks := mtls
+	viaSocks.Proxy = "socks5://" + socks.Addr().String()
+	assert.Nil(get(viaSocks))
+	assert.Equal(int32(1), atomic.LoadInt32(&socksConnects))
+
+	for _, noProxy := range []string{"*", "127.0.0.1", host, "example.com, 127.0.0.0/8"} {
+		bypass := viaSocks
+		bypass.NoProxy = noProxy
+		assert.Nil(get(bypass))
+		assert.Equal(int32(1), atomic.LoadInt32(&socksConnects), "Should not proxy %s.", noProxy)
+	}
+	for _, noProxy := range []string{"127.0.0.2", "127.0.0.1:1", "10.0.0.0/8", "example.com"} {
+		proxied := viaSocks
+		proxied.NoProxy = noProxy
+		before := atomic.LoadInt32(&socksConnects)
+		assert.Nil(get(proxied))
+		assert.Equal(before+1, atomic.LoadInt32(&socksConnects), "Should proxy despite %s.", noProxy)
+	}
+
+	// Settings apply to a fetch even after Client is initialized
+	fetch.InitHttpClient(2.0)
+	viaSocks.TimeoutSeconds = 2.0
+	res, err := fetch.Fetch(fixture.Envkey, viaSocks)
+	assert.Nil(err)
+	assert.Equal(`{"A":"1"}`, res)
+	assert.Equal(int32(6), atomic.LoadInt32(&socksConnects))
+
+	_, err = fetch.Fetch(fixture.Envkey, fetch.FetchOptions{TimeoutSeconds: 2.0})
+	assert.NotNil(err, "Should not reuse the settings without them.")
+
+	invalid := []fetch.FetchOptions{
+		{Proxy: "ftp://proxy:21"},
+		{Proxy: "http://"},
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: keyFile},
+		{ClientCertFile: certFile},
+		{ClientCertFile: certFile, ClientKeyFile: caFile},
+	}
+	for _, options := range invalid {
+		_, err = fetch.NewHttpClient(options)
+		assert.NotNil(err, "Should reject %+v.", options)
+	}
+
+	// NoProxy applies to a proxy from the environment too
+	t.Setenv("HTTPS_PROXY", "socks5://"+socks.Addr().String())
+	before := atomic.LoadInt32(&socksConnects)
+	envProxied := mtls
+	envProxied.NoProxy = "example.com"
+	assert.Nil(get(envProxied))
+	assert.Equal(before+1, atomic.LoadInt32(&socksConnects), "Should use HTTPS_PROXY with NoProxy set.")
+	envProxied.NoProxy = "127.0.0.1"
+	assert.Nil(get(envProxied))
+	assert.Equal(before+1, atomic.LoadInt32(&socksConnects), "Should not use HTTPS_PROXY for hosts in NoProxy.")
+}
+
+func TestTLSPins(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "envkey-fetch-tls-pins")
+	defer os.RemoveAll(dir)
+
+	handler := envkeytest.NewHandler()
+	handler.AddResponse("validkey", &parser.EnvServiceResponse{Env: "env"})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	pin := fetch.TLSPin(server.Certificate())
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	// Pins are by host name, so connect to the server as example.com, which
+	// its certificate is valid for
+	var connects int32
+	socks := socks5Proxy(server.Listener.Addr().String(), &connects)
+	defer socks.Close()
+
+	get := func(pins fetch.TLSPins, reportOnly bool) error {
+		client, err := fetch.NewHttpClient(fetch.FetchOptions{
+			TimeoutSeconds:    2.0,
+			Proxy:             "socks5://" + socks.Addr().String(),
+			CAFile:            caFile,
+			TLSPins:           pins,
+			TLSPinsReportOnly: reportOnly,
+		})
+		if err != nil {
+			return err
+		}
+		res, err := client.Get("https://example.com/v1/validkey")
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+
+	other := "sha256/" + strings.Repeat("A", 43) + "="
+
+	assert.Nil(get(nil, false))
+	assert.Nil(get(fetch.TLSPins{"example.com": {pin}}, false))
+	assert.Nil(get(fetch.TLSPins{"example.com": {other, pin}}, false), "Should accept any of several pins for rotation.")
+	assert.Nil(get(fetch.TLSPins{"EXAMPLE.com:443/path": {strings.TrimPrefix(pin, "sha256/")}}, false), "Should normalize hosts and pins.")
+	assert.Nil(get(fetch.TLSPins{"other.example.com": {other}}, false), "Should only check pinned hosts.")
+
+	err := get(fetch.TLSPins{"example.com": {other}}, false)
+	var pinErr *fetch.TLSPinError
+	if assert.ErrorAs(err, &pinErr) {
+		assert.Equal("example.com", pinErr.Host)
+		assert.Equal([]string{pin}, pinErr.Got)
+	}
+
+	assert.Nil(get(fetch.TLSPins{"example.com": {other}}, true), "Should only report mismatches in report only mode.")
+
+	host, parsed, err := fetch.ParseTLSPin(fetch.BackupHost + "=" + pin)
+	assert.Nil(err)
+	assert.Equal("s3-eu-west-1.amazonaws.com", host)
+	assert.Equal(pin, parsed)
+
+	for _, s := range []string{"example.com", "=" + pin, "example.com=sha256/short", "example.com=not base64!"} {
+		_, _, err = fetch.ParseTLSPin(s)
+		assert.NotNil(err, "Should reject %s.", s)
+	}
+	assert.NotNil(get(fetch.TLSPins{"example.com": {"invalid"}}, false))
+
+	// Pins are enforced even after Client is initialized
+	fixture, err := envkeytest.NewFixture(envkeytest.FixtureOptions{Env: `{"A":"1"}`, Host: "example.com"})
+	if !assert.Nil(err) {
+		return
+	}
+	handler.AddResponse(fixture.Id, fixture.Response)
+	fetch.InitHttpClient(2.0)
+	opts := fetch.FetchOptions{
+		TimeoutSeconds: 2.0,
+		Proxy:          "socks5://" + socks.Addr().String(),
+		CAFile:         caFile,
+		TLSPins:        fetch.TLSPins{"example.com": {other}},
+	}
+	_, err = fetch.Fetch(fixture.Envkey, opts)
+	assert.ErrorAs(err, &pinErr, "Should refuse the connection with a wrong pin.")
+
+	opts.TLSPins = fetch.TLSPins{"example.com": {pin}}
+	res, err := fetch.Fetch(fixture.Envkey, opts)
+	assert.Nil(err)
+	assert.Equal(`{"A":"1"}`, res)
+}
+
 const VALID_LIVE_ENVKEY = "wYv78UmHsfEu6jSqMZrU-3w1kwyF35nRYwsAJ-env-staging.envkey.com"
 const INVALID_LIVE_ENVKEY = "wYv78UmHsfEu6jSqMZrU-3w1kwyF35nRYwsAJinvalid-env-staging.envkey.com"
 const BACKUP_TEST_ENVKEY = "wYv78UmHsfEu6jSqMZrU-3w1kwyF35nRYwsAJ"
@@ -167,12 +1124,12 @@ func TestLiveFetch(t *testing.T) {
 	assert := assert.New(t)
 
 	// Test valid
-	validRes, err := fetch.Fetch(VALID_LIVE_ENVKEY, fetch.FetchOptions{false, "", "envkey-fetch", version.Version, false, 2.0, 1, 0.1})
+	validRes, err := fetch.Fetch(VALID_LIVE_ENVKEY, fetch.FetchOptions{ShouldCache: false, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1})
 	assert.Nil(err)
 	assert.Equal("{\"TEST\":\"it\",\"TEST_2\":\"works!\",\"TEST_INJECTION\":\"'$(uname)\",\"TEST_SINGLE_QUOTES\":\"this' is ok\",\"TEST_SPACES\":\"it does work!\",\"TEST_STRANGE_CHARS\":\"with quotes ` ' \\\\\\\" bäh\"}", validRes)
 
 	// Test invalid
-	invalidRes, err := fetch.Fetch(INVALID_LIVE_ENVKEY, fetch.FetchOptions{false, "", "envkey-fetch", version.Version, false, 2.0, 1, 0.1})
+	invalidRes, err := fetch.Fetch(INVALID_LIVE_ENVKEY, fetch.FetchOptions{ShouldCache: false, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1})
 	assert.NotNil(err)
 	assert.Equal("ENVKEY invalid", string(err.Error()))
 	assert.Equal("", invalidRes)
@@ -186,7 +1143,7 @@ func TestBackup(t *testing.T) {
 
 	// Test with backup
 	fetch.DefaultHost = "localhost:61034"
-	opts := fetch.FetchOptions{false, "", "envkey-fetch", version.Version, false, 2.0, 1, 0.1}
+	opts := fetch.FetchOptions{ShouldCache: false, CacheDir: "", ClientName: "envkey-fetch", ClientVersion: version.Version, VerboseOutput: false, TimeoutSeconds: 2.0, Retries: 1, RetryBackoff: 0.1}
 	url := fetch.UrlWithLoggingParams("https://"+fetch.BackupHost+"/v"+strconv.Itoa(fetch.ApiVersion)+"/validkey", opts)
 	restrictedUrl := fetch.UrlWithLoggingParams(fmt.Sprintf("%s?v=%s&id=%s", ("https://"+fetch.BackupHostRestricted), strconv.Itoa(fetch.ApiVersion), "validkey"), opts)
 
@@ -206,6 +1163,11 @@ func TestBackup(t *testing.T) {
 
 	assert.Nil(err)
 	assert.Equal(validResult, res, "Backup")
+
+	resWithMetadata, err := fetch.FetchWithMetadata(validEnvkeySimple, opts)
+	assert.Nil(err)
+	assert.Equal(fetch.SourceBackup, resWithMetadata.Metadata.Source)
+	assert.Contains([]string{url, restrictedUrl}, resWithMetadata.Metadata.Url)
 }
 
 const customRemoteHost = "env-service.customhost.com"
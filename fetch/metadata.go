@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/envkey/envkey-fetch/config"
+	"github.com/envkey/envkey-fetch/parser"
+	"github.com/envkey/envkey-fetch/trust"
+)
+
+const (
+	SourcePrimary  = "primary"
+	SourceBackup   = "backup"
+	SourceCache    = "cache"
+	SourceFile     = "file"
+	SourceSnapshot = "snapshot"
+)
+
+type Latency struct {
+	Network    time.Duration
+	KeyParsing time.Duration
+	TrustChain time.Duration
+	Decryption time.Duration
+}
+
+// MarshalJSON renders each phase in milliseconds for dashboards and logs.
+func (latency Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{
+		"networkMs":    durationMs(latency.Network),
+		"keyParsingMs": durationMs(latency.KeyParsing),
+		"trustChainMs": durationMs(latency.TrustChain),
+		"decryptionMs": durationMs(latency.Decryption),
+	})
+}
+
+type Metadata struct {
+	Source                       string  `json:"source"`
+	Url                          string  `json:"url,omitempty"`
+	File                         string  `json:"file,omitempty"`
+	Attempts                     int     `json:"attempts"`
+	ApiVersion                   int     `json:"apiVersion,omitempty"`
+	Latency                      Latency `json:"latency"`
+	SignerId                     string  `json:"signerId"`
+	InheritanceOverridesApplied  bool    `json:"inheritanceOverridesApplied"`
+	InheritanceOverridesSignerId string  `json:"inheritanceOverridesSignerId,omitempty"`
+	// CacheAge is the age of a cached response or snapshot.
+	CacheAge time.Duration `json:"-"`
+
+	// TrustChain is only set with FetchOptions.Explain.
+	TrustChain []*trust.Explanation `json:"trustChain,omitempty"`
+}
+
+func (metadata Metadata) MarshalJSON() ([]byte, error) {
+	type alias Metadata
+	var cacheAgeMs, snapshotAgeMs *float64
+	ms := durationMs(metadata.CacheAge)
+	switch metadata.Source {
+	case SourceCache:
+		cacheAgeMs = &ms
+	case SourceSnapshot:
+		snapshotAgeMs = &ms
+	}
+
+	return json.Marshal(struct {
+		alias
+		CacheAgeMs    *float64 `json:"cacheAgeMs,omitempty"`
+		SnapshotAgeMs *float64 `json:"snapshotAgeMs,omitempty"`
+	}{alias(metadata), cacheAgeMs, snapshotAgeMs})
+}
+
+// verifyAt is the time a response is verified at. Snapshots are verified as
+// of when they were fetched, so keys that have since expired don't invalidate
+// them, since their fetch time is authenticated by their MAC. Everything else,
+// including cached responses, whose age is only the cache file's modification
+// time, is verified as of now.
+func (metadata *Metadata) verifyAt() time.Time {
+	if metadata.Source == SourceSnapshot {
+		return time.Now().Add(-metadata.CacheAge)
+	}
+	return time.Now()
+}
+
+type Result struct {
+	Env      string
+	Metadata Metadata
+}
+
+// EnvMap decodes the env, with numbers decoded as json.Number.
+func (result *Result) EnvMap() (map[string]interface{}, error) {
+	env, err := parser.ParseEnv([]byte(result.Env))
+	if err != nil {
+		return nil, err
+	}
+	return env.Map(), nil
+}
+
+// Config returns the env as a config that keeps the order keys were served in.
+func (result *Result) Config() (*config.Config, error) {
+	env, err := parser.ParseEnv([]byte(result.Env))
+	if err != nil {
+		return nil, err
+	}
+	return env.Config(), nil
+}
+
+// MarshalJSON renders the result as an envelope with the decrypted env
+// embedded as json alongside its metadata.
+func (result *Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Env      json.RawMessage `json:"env"`
+		Metadata Metadata        `json:"metadata"`
+	}{json.RawMessage(result.Env), result.Metadata})
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,203 @@
+package fetch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/envkey/envkey-fetch/output"
+	"github.com/envkey/envkey-fetch/parser"
+	"github.com/envkey/envkey-fetch/version"
+)
+
+// SnapshotFormat is the version of the snapshot file format.
+const SnapshotFormat = 1
+
+var ErrSnapshotEnvkey = errors.New("snapshot is for a different ENVKEY")
+var ErrSnapshotMac = errors.New("snapshot MAC invalid, the ENVKEY is wrong or the snapshot was modified")
+
+// Snapshot is a verified response saved, still encrypted and signed, as a
+// portable artifact, along with where and when it was fetched. Response is
+// the response as served, in ApiVersion. Mac authenticates the rest, so that
+// FetchedAt, which the max age and verification time depend on, can't be
+// changed without the envkey.
+type Snapshot struct {
+	Format             int             `json:"format"`
+	Id                 string          `json:"id"`
+	FetchedAt          time.Time       `json:"fetchedAt"`
+	Source             string          `json:"source"`
+	Url                string          `json:"url,omitempty"`
+	ApiVersion         int             `json:"apiVersion"`
+	EnvkeyFetchVersion string          `json:"envkeyFetchVersion"`
+	Response           json.RawMessage `json:"response"`
+	Mac                string          `json:"mac,omitempty"`
+}
+
+// SnapshotTooOldError is returned for a snapshot fetched longer ago than
+// FetchOptions.SnapshotMaxAge.
+type SnapshotTooOldError struct {
+	Path      string
+	FetchedAt time.Time
+	MaxAge    time.Duration
+}
+
+func (err *SnapshotTooOldError) Error() string {
+	return fmt.Sprintf("snapshot %s was fetched at %s, more than %s ago", err.Path, err.FetchedAt.Format(time.RFC3339), err.MaxAge)
+}
+
+// FetchSnapshot fetches the response for an envkey and verifies it like a
+// fetch would, then returns it as a snapshot without keeping anything
+// decrypted.
+func FetchSnapshot(envkey string, options FetchOptions) (*Snapshot, error) {
+	if len(strings.Split(envkey, "-")) < 2 {
+		return nil, errors.New("ENVKEY invalid")
+	}
+
+	pinnedRoots, err := resolvePinnedRoots(envkey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshot what's served, not another snapshot
+	options.Snapshot = ""
+
+	metadata := new(Metadata)
+	response, _, envkeyParam, pw, err := fetchResponse(envkey, options, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	fetchedAt := metadata.verifyAt()
+	_, err = parseResponse(response, envkeyParam, pw, fetchedAt, pinnedRoots, options)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := parser.EncodeResponse(response, metadata.ApiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Format:             SnapshotFormat,
+		Id:                 envkeyParam,
+		FetchedAt:          fetchedAt.UTC(),
+		Source:             metadata.Source,
+		Url:                metadata.Url,
+		ApiVersion:         metadata.ApiVersion,
+		EnvkeyFetchVersion: version.Version,
+		Response:           body,
+	}
+	snapshot.Mac, err = snapshot.mac(pw)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// mac is the HMAC of the snapshot without its Mac, keyed from the envkey
+// passphrase like the verified links memo.
+func (snapshot *Snapshot) mac(pw string) (string, error) {
+	unsigned := *snapshot
+	unsigned.Mac = ""
+	// Marshal compacts Response, so the MAC doesn't depend on indentation
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+	secret := sha256.Sum256([]byte("envkey-fetch snapshot:" + pw))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (snapshot *Snapshot) verifyMac(pw string) error {
+	expected, err := snapshot.mac(pw)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(snapshot.Mac)) {
+		return ErrSnapshotMac
+	}
+	return nil
+}
+
+// WriteFile atomically writes the snapshot to path with 0600 permissions.
+func (snapshot *Snapshot) WriteFile(path string) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return output.WriteAtomic(path, append(data, '\n'))
+}
+
+// ReadSnapshot reads a snapshot of at most maxBytes from path.
+func ReadSnapshot(path string, maxBytes int64) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxBytes+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > maxBytes {
+		return nil, &ResponseTooLargeError{path, maxBytes}
+	}
+
+	snapshot := new(Snapshot)
+	err = json.Unmarshal(data, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	if snapshot.Format != SnapshotFormat {
+		return nil, fmt.Errorf("unsupported snapshot format %d in %s", snapshot.Format, path)
+	} else if len(snapshot.Response) == 0 {
+		return nil, fmt.Errorf("snapshot %s has no response", path)
+	}
+	return snapshot, nil
+}
+
+// snapshotResponse reads the response for an envkey from options.Snapshot,
+// checking its MAC and enforcing options.SnapshotMaxAge, and records it in
+// metadata.
+func snapshotResponse(envkey string, options FetchOptions, metadata *Metadata) (*parser.EnvServiceResponse, string, string, error) {
+	snapshot, err := ReadSnapshot(options.Snapshot, options.maxResponseBytes())
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	envkeyParam, pw, _ := splitEnvkey(envkey)
+	if snapshot.Id != envkeyParam {
+		return nil, "", "", ErrSnapshotEnvkey
+	}
+	err = snapshot.verifyMac(pw)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	age := time.Since(snapshot.FetchedAt)
+	if options.SnapshotMaxAge > 0 && age > options.SnapshotMaxAge {
+		return nil, "", "", &SnapshotTooOldError{options.Snapshot, snapshot.FetchedAt, options.SnapshotMaxAge}
+	}
+
+	response, version, err := parser.DecodeResponse(snapshot.Response, parser.DecodeOptions{
+		DisallowUnknownFields: options.StrictDecode,
+		ApiVersion:            snapshot.ApiVersion,
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	metadata.Source, metadata.File, metadata.ApiVersion, metadata.CacheAge = SourceSnapshot, options.Snapshot, version, age
+	return response, envkeyParam, pw, nil
+}
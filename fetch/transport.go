@@ -0,0 +1,379 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+const tlsPinPrefix = "sha256/"
+
+// TLSPins maps hosts to pins of public keys, one of which must be in the
+// certificate chain the host presents.
+type TLSPins map[string][]string
+
+// TLSPinError is returned when no certificate presented by Host has a pinned
+// public key. Got are the pins of the certificates it presented.
+type TLSPinError struct {
+	Host string
+	Got  []string
+}
+
+func (err *TLSPinError) Error() string {
+	return fmt.Sprintf("no pinned public key in certificates for %s, got: %s", err.Host, strings.Join(err.Got, ", "))
+}
+
+// TLSPin returns the pin of a certificate's public key, sha256/ followed by
+// the base64 SHA-256 hash of its DER-encoded SubjectPublicKeyInfo.
+func TLSPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return tlsPinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParseTLSPin parses host=pin. The host may be a url host with a port or
+// path, like BackupHost, and the sha256/ prefix of the pin is optional.
+func ParseTLSPin(s string) (string, string, error) {
+	split := strings.SplitN(s, "=", 2)
+	if len(split) != 2 {
+		return "", "", fmt.Errorf("invalid TLS pin, expected host=sha256/BASE64: %s", s)
+	}
+	host := tlsPinHost(split[0])
+	pin, err := normalizeTLSPin(split[1])
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("invalid TLS pin host: %s", s)
+	}
+	return host, pin, nil
+}
+
+// Add pins a public key for host, in addition to any already pinned.
+func (pins TLSPins) Add(host, pin string) {
+	pins[host] = append(pins[host], pin)
+}
+
+func tlsPinHost(host string) string {
+	host = strings.SplitN(host, "/", 2)[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSpace(host))
+}
+
+func normalizeTLSPin(pin string) (string, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), tlsPinPrefix)
+	sum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("invalid TLS pin, expected a base64 SHA-256 hash: %s", pin)
+	}
+	return tlsPinPrefix + pin, nil
+}
+
+var clientsMu sync.Mutex
+var clients = make(map[string]*http.Client)
+
+// transportSettings are the options that change how a client connects.
+type transportSettings struct {
+	TimeoutSeconds    float64
+	Proxy             string
+	NoProxy           string
+	CAFile            string
+	ClientCertFile    string
+	ClientKeyFile     string
+	TLSPins           TLSPins
+	TLSPinsReportOnly bool
+}
+
+func (options FetchOptions) transportSettings() transportSettings {
+	return transportSettings{
+		TimeoutSeconds:    options.TimeoutSeconds,
+		Proxy:             options.Proxy,
+		NoProxy:           options.NoProxy,
+		CAFile:            options.CAFile,
+		ClientCertFile:    options.ClientCertFile,
+		ClientKeyFile:     options.ClientKeyFile,
+		TLSPins:           options.TLSPins,
+		TLSPinsReportOnly: options.TLSPinsReportOnly,
+	}
+}
+
+// httpClient returns the client for a fetch. Without proxy or TLS settings
+// that's Client, which may be initialized already when mocking for tests.
+// Otherwise it's a client built for the settings, so they're never dropped
+// in favor of a Client initialized by an earlier fetch or InitHttpClient.
+func httpClient(options FetchOptions) (*http.Client, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if options.Proxy == "" && options.NoProxy == "" && options.CAFile == "" &&
+		options.ClientCertFile == "" && options.ClientKeyFile == "" && len(options.TLSPins) == 0 {
+		if Client == nil {
+			InitHttpClient(options.TimeoutSeconds)
+		}
+		return Client, nil
+	}
+
+	keyJson, err := json.Marshal(options.transportSettings())
+	if err != nil {
+		return nil, err
+	}
+	key := string(keyJson)
+	if client := clients[key]; client != nil {
+		return client, nil
+	}
+
+	client, err := NewHttpClient(options)
+	if err != nil {
+		return nil, err
+	}
+	clients[key] = client
+	return client, nil
+}
+
+// NewHttpClient builds a client with the timeout, proxy and TLS settings in
+// options.
+func NewHttpClient(options FetchOptions) (*http.Client, error) {
+	to := time.Second * time.Duration(options.TimeoutSeconds)
+
+	proxy, err := proxyFunc(options)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := clientTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout: to,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			Dial: (&net.Dialer{
+				Timeout: to,
+			}).Dial,
+			TLSHandshakeTimeout: to,
+			TLSClientConfig:     tlsConfig,
+		},
+	}, nil
+}
+
+// proxyFunc returns options.Proxy, or without it the HTTPS_PROXY or
+// HTTP_PROXY environment variable for the request's scheme, for every request
+// except to hosts in options.NoProxy, or NO_PROXY if that's empty. Without
+// either option, the environment is left to http.ProxyFromEnvironment.
+func proxyFunc(options FetchOptions) (func(*http.Request) (*url.URL, error), error) {
+	if options.Proxy == "" && options.NoProxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyUrls := make(map[string]*url.URL)
+	if options.Proxy != "" {
+		proxyUrl, err := parseProxy(options.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxyUrls["http"], proxyUrls["https"] = proxyUrl, proxyUrl
+	} else {
+		for scheme, env := range map[string]string{"http": "HTTP_PROXY", "https": "HTTPS_PROXY"} {
+			s := os.Getenv(env)
+			if s == "" {
+				s = os.Getenv(strings.ToLower(env))
+			}
+			if s == "" {
+				continue
+			}
+			proxyUrl, err := parseProxy(s)
+			if err != nil {
+				return nil, err
+			}
+			proxyUrls[scheme] = proxyUrl
+		}
+	}
+
+	noProxy := options.NoProxy
+	if noProxy == "" {
+		noProxy = os.Getenv("NO_PROXY")
+	}
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyUrls[req.URL.Scheme], nil
+	}, nil
+}
+
+func parseProxy(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	proxyUrl, err := url.Parse(s)
+	if err != nil || proxyUrl.Host == "" {
+		return nil, fmt.Errorf("invalid proxy: %s", s)
+	}
+	for _, scheme := range proxySchemes {
+		if proxyUrl.Scheme == scheme {
+			return proxyUrl, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %s, expected one of: %s", proxyUrl.Scheme, strings.Join(proxySchemes, ", "))
+}
+
+// bypassProxy matches a url against a comma-separated NO_PROXY list of
+// hosts, which also match their subdomains, ip addresses and CIDR ranges,
+// each optionally with a port, or * for every host.
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		} else if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		if entryIp := net.ParseIP(entryHost); entryIp != nil {
+			if ip != nil && entryIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientTLSConfig trusts options.CAFile in addition to the system roots,
+// presents options.ClientCertFile for mutual TLS, and checks options.TLSPins.
+func clientTLSConfig(options FetchOptions) (*tls.Config, error) {
+	if options.CAFile == "" && options.ClientCertFile == "" && options.ClientKeyFile == "" && len(options.TLSPins) == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		if options.ClientCertFile == "" || options.ClientKeyFile == "" {
+			return nil, errors.New("a client certificate and key are both required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(options.TLSPins) > 0 {
+		pins := make(TLSPins)
+		for host, hostPins := range options.TLSPins {
+			for _, pin := range hostPins {
+				normalized, err := normalizeTLSPin(pin)
+				if err != nil {
+					return nil, err
+				}
+				pins.Add(tlsPinHost(host), normalized)
+			}
+		}
+		tlsConfig.VerifyConnection = verifyTLSPins(pins, options.TLSPinsReportOnly)
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyTLSPins checks the chains verified for a pinned host for a pinned
+// public key, after the usual certificate verification. With reportOnly,
+// mismatches are logged to stderr instead of failing the connection.
+func verifyTLSPins(pins TLSPins, reportOnly bool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		host := strings.ToLower(state.ServerName)
+		hostPins := pins[host]
+		if len(hostPins) == 0 {
+			return nil
+		}
+
+		chains := state.VerifiedChains
+		if len(chains) == 0 {
+			chains = [][]*x509.Certificate{state.PeerCertificates}
+		}
+		var got []string
+		for _, chain := range chains {
+			for _, cert := range chain {
+				pin := TLSPin(cert)
+				for _, hostPin := range hostPins {
+					if pin == hostPin {
+						return nil
+					}
+				}
+				got = append(got, pin)
+			}
+		}
+
+		err := &TLSPinError{host, got}
+		if reportOnly {
+			fmt.Fprintf(os.Stderr, "TLS pin mismatch (report only): %s\n", err)
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,141 @@
+package output
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/envkey/envkey-fetch/config"
+)
+
+var k8sKeyRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+func renderK8sSecret(values *config.Config, options Options) ([]byte, error) {
+	data := make(map[string]string)
+	for _, k := range values.Keys() {
+		v, _ := values.Get(k)
+		data[k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return renderK8sManifest("Secret", data, options)
+}
+
+func renderK8sConfigMap(values *config.Config, options Options) ([]byte, error) {
+	if len(options.ConfigMapKeys) == 0 {
+		return nil, errors.New("ConfigMap output requires an allowlist of non-secret keys.")
+	}
+
+	data := make(map[string]string)
+	for _, k := range options.ConfigMapKeys {
+		v, ok := values.Get(k)
+		if !ok {
+			return nil, errors.New("ConfigMap key not found in config: " + k)
+		}
+		data[k] = v
+	}
+	return renderK8sManifest("ConfigMap", data, options)
+}
+
+func renderK8sManifest(kind string, data map[string]string, options Options) ([]byte, error) {
+	if options.Name == "" {
+		return nil, errors.New(kind + " output requires a name.")
+	}
+
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		if !k8sKeyRegexp.MatchString(k) {
+			return nil, errors.New("Key is not a valid " + kind + " data key: " + k)
+		} else if !utf8.ValidString(v) {
+			return nil, errors.New("Value is not valid UTF-8, which a " + kind + " can't hold: " + k)
+		}
+		keys = append(keys, k)
+	}
+	if !utf8.ValidString(options.Name) || !utf8.ValidString(options.Namespace) {
+		return nil, errors.New(kind + " name and namespace must be valid UTF-8.")
+	}
+	for k, v := range options.Labels {
+		if !utf8.ValidString(k) || !utf8.ValidString(v) {
+			return nil, errors.New(kind + " labels must be valid UTF-8.")
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("apiVersion: v1\n")
+	fmt.Fprintf(&buf, "kind: %s\n", kind)
+	buf.WriteString("metadata:\n")
+	fmt.Fprintf(&buf, "  name: %s\n", yamlQuote(options.Name))
+	if options.Namespace != "" {
+		fmt.Fprintf(&buf, "  namespace: %s\n", yamlQuote(options.Namespace))
+	}
+	if len(options.Labels) > 0 {
+		labelKeys := make([]string, 0, len(options.Labels))
+		for k := range options.Labels {
+			labelKeys = append(labelKeys, k)
+		}
+		sort.Strings(labelKeys)
+
+		buf.WriteString("  labels:\n")
+		for _, k := range labelKeys {
+			fmt.Fprintf(&buf, "    %s: %s\n", yamlQuote(k), yamlQuote(options.Labels[k]))
+		}
+	}
+	if kind == "Secret" {
+		buf.WriteString("type: Opaque\n")
+	}
+
+	if len(keys) == 0 {
+		buf.WriteString("data: {}\n")
+	} else {
+		buf.WriteString("data:\n")
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "  %s: %s\n", yamlQuote(k), yamlQuote(data[k]))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// yamlQuote renders s as a double-quoted yaml scalar, which is also a json
+// string. Runes yaml doesn't allow unescaped, like DEL and C1 controls, and
+// line breaks it would fold are escaped. s must be valid UTF-8.
+func yamlQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case yamlPrintable(r):
+			buf.WriteRune(r)
+		default:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// yamlPrintable is yaml's printable character set, less the byte order mark
+// and the line and paragraph separators.
+func yamlPrintable(r rune) bool {
+	switch {
+	case r >= 0x20 && r <= 0x7e:
+		return true
+	case r == 0x2028 || r == 0x2029 || r == 0xfeff:
+		return false
+	case r >= 0xa0 && r <= 0xd7ff, r >= 0xe000 && r <= 0xfffd, r >= 0x10000 && r <= utf8.MaxRune:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/envkey/envkey-fetch/config"
+)
+
+const (
+	FormatJson         = "json"
+	FormatDotenv       = "dotenv"
+	FormatShell        = "shell"
+	FormatK8sSecret    = "k8s-secret"
+	FormatK8sConfigMap = "k8s-configmap"
+)
+
+var Formats = []string{FormatJson, FormatDotenv, FormatShell, FormatK8sSecret, FormatK8sConfigMap}
+
+// Options are only used by the Kubernetes manifest formats.
+type Options struct {
+	Name      string
+	Namespace string
+	Labels    map[string]string
+	// ConfigMapKeys is the allowlist of non-secret keys included in a ConfigMap.
+	ConfigMapKeys []string
+}
+
+// manifestName lists the keys written by WriteDir so that keys removed from
+// the config can be cleaned up without touching unrelated files.
+const manifestName = ".envkey-fetch-keys"
+
+// Render renders values in their key order, except for the Kubernetes
+// manifest formats, which sort keys.
+func Render(values *config.Config, format string, options Options) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "", FormatJson:
+		envJson, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(envJson)
+		buf.WriteString("\n")
+	case FormatDotenv:
+		for _, k := range values.Keys() {
+			v, _ := values.Get(k)
+			fmt.Fprintf(&buf, "%s=%s\n", k, dotenvQuote(v))
+		}
+	case FormatShell:
+		for _, k := range values.Keys() {
+			v, _ := values.Get(k)
+			fmt.Fprintf(&buf, "export %s=%s\n", k, shellQuote(v))
+		}
+	case FormatK8sSecret:
+		return renderK8sSecret(values, options)
+	case FormatK8sConfigMap:
+		return renderK8sConfigMap(values, options)
+	default:
+		return nil, errors.New("Unknown output format: " + format)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// WriteFile atomically writes the rendered env to path with 0600 permissions.
+func WriteFile(path string, values *config.Config, format string, options Options) error {
+	b, err := Render(values, format, options)
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(path, b)
+}
+
+// WriteDir writes each key to its own file in dir, in the style of a mounted
+// secrets volume. Files for keys that were written previously but are no longer
+// present in values are removed.
+func WriteDir(dir string, values *config.Config) error {
+	var err error
+	keys := values.Keys()
+
+	for _, k := range keys {
+		if !validFileName(k) {
+			return errors.New("Key can't be used as a file name: " + k)
+		}
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	previousKeys, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		v, _ := values.Get(k)
+		err = WriteAtomic(filepath.Join(dir, k), []byte(v))
+		if err != nil {
+			return err
+		}
+	}
+
+	current := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		current[k] = true
+	}
+	for _, k := range previousKeys {
+		if !current[k] && validFileName(k) {
+			err = os.Remove(filepath.Join(dir, k))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return WriteAtomic(filepath.Join(dir, manifestName), []byte(strings.Join(keys, "\n")+"\n"))
+}
+
+func readManifest(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// WriteAtomic writes b to path with 0600 permissions through a temp file in
+// the same directory, so a crash never leaves a partial file behind.
+func WriteAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	// TempFile already creates with 0600, but be explicit since it's the point
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = tmp.Write(b)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func validFileName(key string) bool {
+	return key != "" &&
+		key != "." &&
+		key != ".." &&
+		key != manifestName &&
+		!strings.ContainsAny(key, "/\\\x00")
+}
+
+func dotenvQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
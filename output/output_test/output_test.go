@@ -0,0 +1,182 @@
+package output_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/envkey/envkey-fetch/config"
+	"github.com/envkey/envkey-fetch/output"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var env = config.New(map[string]interface{}{
+	"TEST":        "it",
+	"TEST_2":      "works!",
+	"TEST_QUOTES": `this' is "ok"`,
+})
+
+func TestRender(t *testing.T) {
+	var res []byte
+	var err error
+
+	res, err = output.Render(env, output.FormatJson, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, `{"TEST":"it","TEST_2":"works!","TEST_QUOTES":"this' is \"ok\""}`+"\n", string(res))
+
+	res, err = output.Render(env, output.FormatDotenv, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, "TEST=\"it\"\nTEST_2=\"works!\"\nTEST_QUOTES=\"this' is \\\"ok\\\"\"\n", string(res))
+
+	res, err = output.Render(env, output.FormatShell, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, "export TEST='it'\nexport TEST_2='works!'\nexport TEST_QUOTES='this'\\'' is \"ok\"'\n", string(res))
+
+	_, err = output.Render(env, "yaml", output.Options{})
+	assert.NotNil(t, err, "Should return an error for unknown formats.")
+}
+
+func TestRenderOrderedTyped(t *testing.T) {
+	values := config.NewOrdered([]string{"Z", "A", "ID", "ON"}, map[string]interface{}{
+		"A":  "first",
+		"Z":  "last",
+		"ID": json.Number("9007199254740993"),
+		"ON": true,
+	})
+
+	res, err := output.Render(values, output.FormatJson, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, `{"Z":"last","A":"first","ID":9007199254740993,"ON":true}`+"\n", string(res), "Should keep key order and exact numbers.")
+
+	res, err = output.Render(values, output.FormatDotenv, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, "Z=\"last\"\nA=\"first\"\nID=\"9007199254740993\"\nON=\"true\"\n", string(res))
+
+	res, err = output.Render(values, output.FormatShell, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, "export Z='last'\nexport A='first'\nexport ID='9007199254740993'\nexport ON='true'\n", string(res))
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "envkey-fetch-output")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.env")
+	err := output.WriteFile(path, env, output.FormatDotenv, output.Options{})
+	assert.Nil(t, err, "Should not return an error.")
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "Should write the file.")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Should restrict permissions.")
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files), "Should not leave temp files behind.")
+}
+
+func TestWriteDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "envkey-fetch-output")
+	defer os.RemoveAll(dir)
+
+	err := output.WriteDir(dir, env)
+	assert.Nil(t, err, "Should not return an error.")
+
+	res, _ := ioutil.ReadFile(filepath.Join(dir, "TEST_2"))
+	assert.Equal(t, "works!", string(res), "Should write one file per key.")
+
+	ioutil.WriteFile(filepath.Join(dir, "UNMANAGED"), []byte("keep me"), 0600)
+
+	err = output.WriteDir(dir, config.New(map[string]interface{}{"TEST": "updated"}))
+	assert.Nil(t, err, "Should not return an error.")
+
+	res, _ = ioutil.ReadFile(filepath.Join(dir, "TEST"))
+	assert.Equal(t, "updated", string(res), "Should update existing keys.")
+
+	_, err = os.Stat(filepath.Join(dir, "TEST_2"))
+	assert.True(t, os.IsNotExist(err), "Should remove keys that disappeared.")
+
+	_, err = os.Stat(filepath.Join(dir, "UNMANAGED"))
+	assert.Nil(t, err, "Should not remove files it didn't write.")
+
+	err = output.WriteDir(dir, config.New(map[string]interface{}{"../escape": "nope"}))
+	assert.NotNil(t, err, "Should reject keys that aren't valid file names.")
+}
+
+func TestRenderK8s(t *testing.T) {
+	var res []byte
+	var err error
+
+	options := output.Options{
+		Name:          "app-config",
+		Namespace:     "prod",
+		Labels:        map[string]string{"app": "web", "env": "production"},
+		ConfigMapKeys: []string{"TEST"},
+	}
+
+	res, err = output.Render(env, output.FormatK8sSecret, options)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, `apiVersion: v1
+kind: Secret
+metadata:
+  name: "app-config"
+  namespace: "prod"
+  labels:
+    "app": "web"
+    "env": "production"
+type: Opaque
+data:
+  "TEST": "aXQ="
+  "TEST_2": "d29ya3Mh"
+  "TEST_QUOTES": "dGhpcycgaXMgIm9rIg=="
+`, string(res))
+
+	res, err = output.Render(env, output.FormatK8sConfigMap, options)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: "app-config"
+  namespace: "prod"
+  labels:
+    "app": "web"
+    "env": "production"
+data:
+  "TEST": "it"
+`, string(res))
+
+	_, err = output.Render(env, output.FormatK8sSecret, output.Options{})
+	assert.NotNil(t, err, "Should require a name.")
+
+	_, err = output.Render(env, output.FormatK8sConfigMap, output.Options{Name: "app-config"})
+	assert.NotNil(t, err, "Should require a ConfigMap allowlist.")
+
+	_, err = output.Render(env, output.FormatK8sConfigMap, output.Options{Name: "app-config", ConfigMapKeys: []string{"MISSING"}})
+	assert.NotNil(t, err, "Should return an error for allowlisted keys that don't exist.")
+
+	_, err = output.Render(config.New(map[string]interface{}{"NOT VALID": "x"}), output.FormatK8sSecret, output.Options{Name: "app-config"})
+	assert.NotNil(t, err, "Should reject invalid data keys.")
+
+	res, err = output.Render(config.New(map[string]interface{}{"TEST": "a\x7fb\u0085c\u2028d\"\\\n\u00e9"}), output.FormatK8sConfigMap, output.Options{
+		Name:          "app-config",
+		Labels:        map[string]string{"note": "x\x7f"},
+		ConfigMapKeys: []string{"TEST"},
+	})
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: "app-config"
+  labels:
+    "note": "x\u007f"
+data:
+  "TEST": "a\u007fb\u0085c\u2028d\"\\\né"
+`, string(res), "Should escape characters yaml doesn't allow unquoted or would fold.")
+
+	_, err = output.Render(config.New(map[string]interface{}{"TEST": "a\xffb"}), output.FormatK8sConfigMap, output.Options{Name: "app-config", ConfigMapKeys: []string{"TEST"}})
+	assert.NotNil(t, err, "Should reject values that aren't valid UTF-8.")
+
+	_, err = output.Render(env, output.FormatK8sSecret, output.Options{Name: "app-config", Labels: map[string]string{"app": "\xff"}})
+	assert.NotNil(t, err, "Should reject labels that aren't valid UTF-8.")
+}
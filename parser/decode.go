@@ -0,0 +1,37 @@
+package parser
+
+type DecodeOptions struct {
+	// DisallowUnknownFields rejects responses with fields that the response
+	// schema of their api version doesn't have.
+	DisallowUnknownFields bool
+
+	// ApiVersion, if set, is the api version negotiated for the response.
+	// Otherwise it's read from the response.
+	ApiVersion int
+}
+
+// DecodeError is returned when a service response isn't a valid json
+// response of its api version.
+type DecodeError struct {
+	Err error
+}
+
+func (err *DecodeError) Error() string {
+	return "Invalid response: " + err.Err.Error()
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+// Decode reads a json service response of any supported api version into
+// response, replacing its contents. Anything after the response object is an
+// error.
+func (response *EnvServiceResponse) Decode(data []byte, options DecodeOptions) error {
+	decoded, _, err := DecodeResponse(data, options)
+	if err != nil {
+		return err
+	}
+	*response = *decoded
+	return nil
+}
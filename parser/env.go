@@ -0,0 +1,184 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/envkey/envkey-fetch/config"
+)
+
+// Env is a decrypted env. It keeps keys in the order they were served and
+// values as the raw json they were served as, so numbers and other non-string
+// values are never rounded or reformatted.
+type Env struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func NewEnv() *Env {
+	return &Env{values: make(map[string]json.RawMessage)}
+}
+
+// ParseEnv reads a json object into an Env. A repeated key keeps its first
+// position and its last value, as encoding/json would.
+func ParseEnv(data []byte) (*Env, error) {
+	env := NewEnv()
+	err := env.UnmarshalJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (env *Env) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("Env must be a json object.")
+	}
+
+	env.keys = nil
+	env.values = make(map[string]json.RawMessage)
+
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return errors.New("Env keys must be strings.")
+		}
+
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			return err
+		}
+
+		var compacted bytes.Buffer
+		err = json.Compact(&compacted, raw)
+		if err != nil {
+			return err
+		}
+		env.Set(key, compacted.Bytes())
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return errors.New("Unexpected data after env.")
+	}
+	return nil
+}
+
+// MarshalJSON writes the env as a json object in key order.
+func (env *Env) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range env.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(env.values[k])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (env *Env) Keys() []string {
+	return append([]string{}, env.keys...)
+}
+
+func (env *Env) Len() int {
+	return len(env.keys)
+}
+
+// Get returns the raw json value of key.
+func (env *Env) Get(key string) (json.RawMessage, bool) {
+	raw, ok := env.values[key]
+	return raw, ok
+}
+
+// Set sets key to a raw json value, appending key if it's new.
+func (env *Env) Set(key string, value json.RawMessage) {
+	if _, ok := env.values[key]; !ok {
+		env.keys = append(env.keys, key)
+	}
+	env.values[key] = value
+}
+
+func (env *Env) setString(key, value string) {
+	raw, _ := json.Marshal(value)
+	env.Set(key, raw)
+}
+
+// Value decodes the value of key. Numbers are decoded as json.Number.
+func (env *Env) Value(key string) (interface{}, bool) {
+	raw, ok := env.values[key]
+	if !ok {
+		return nil, false
+	}
+	v, err := decodeValue(raw)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Map decodes the env into a map, with numbers decoded as json.Number.
+func (env *Env) Map() map[string]interface{} {
+	res := make(map[string]interface{}, len(env.keys))
+	for _, k := range env.keys {
+		res[k], _ = env.Value(k)
+	}
+	return res
+}
+
+// Config returns the env as a config.Config that keeps the env's key order.
+func (env *Env) Config() *config.Config {
+	return config.NewOrdered(env.Keys(), env.Map())
+}
+
+// Delete removes key.
+func (env *Env) Delete(key string) {
+	if _, ok := env.values[key]; !ok {
+		return
+	}
+	delete(env.values, key)
+	for i, k := range env.keys {
+		if k == key {
+			env.keys = append(env.keys[:i:i], env.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (env *Env) clone() *Env {
+	res := NewEnv()
+	for _, k := range env.keys {
+		res.Set(k, env.values[k])
+	}
+	return res
+}
+
+func decodeValue(raw json.RawMessage) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
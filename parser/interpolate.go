@@ -0,0 +1,243 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type InterpolateOptions struct {
+	// ProcessEnv falls back to the process environment for references that
+	// aren't defined in the config itself.
+	ProcessEnv bool
+}
+
+type UndefinedReferenceError struct {
+	Key       string
+	Reference string
+}
+
+func (err *UndefinedReferenceError) Error() string {
+	return fmt.Sprintf("Undefined reference ${%s} in %s.", err.Reference, err.Key)
+}
+
+type CycleError struct {
+	Cycle []string
+}
+
+func (err *CycleError) Error() string {
+	return "Reference cycle: " + strings.Join(err.Cycle, " -> ")
+}
+
+type InterpolationSyntaxError struct {
+	Key    string
+	Offset int
+}
+
+func (err *InterpolationSyntaxError) Error() string {
+	return fmt.Sprintf("Unterminated reference in %s at offset %d.", err.Key, err.Offset)
+}
+
+// Interpolate expands ${VAR} and ${VAR:-default} references in string values
+// and returns a new map. $$ is an escaped literal $. Bare $VAR is left as is.
+func Interpolate(env map[string]interface{}, options InterpolateOptions) (map[string]interface{}, error) {
+	in := interpolator{
+		env:      env,
+		options:  options,
+		resolved: make(map[string]string),
+		visiting: make(map[string]bool),
+	}
+
+	res := make(map[string]interface{}, len(env))
+	for k, v := range env {
+		if _, ok := v.(string); !ok {
+			res[k] = v
+			continue
+		}
+
+		s, err := in.resolveKey(k)
+		if err != nil {
+			return nil, err
+		}
+		res[k] = s
+	}
+
+	return res, nil
+}
+
+// InterpolateEnv is Interpolate for an Env. Keys keep their order, and
+// values that aren't strings are copied unchanged.
+func InterpolateEnv(env *Env, options InterpolateOptions) (*Env, error) {
+	in := interpolator{
+		env:      env.Map(),
+		options:  options,
+		resolved: make(map[string]string),
+		visiting: make(map[string]bool),
+	}
+
+	res := NewEnv()
+	for _, k := range env.keys {
+		if _, ok := in.env[k].(string); !ok {
+			res.Set(k, env.values[k])
+			continue
+		}
+
+		s, err := in.resolveKey(k)
+		if err != nil {
+			return nil, err
+		}
+		res.setString(k, s)
+	}
+
+	return res, nil
+}
+
+type interpolator struct {
+	env      map[string]interface{}
+	options  InterpolateOptions
+	resolved map[string]string
+	visiting map[string]bool
+	stack    []string
+}
+
+func (in *interpolator) resolveKey(key string) (string, error) {
+	if s, ok := in.resolved[key]; ok {
+		return s, nil
+	}
+
+	if in.visiting[key] {
+		var cycle []string
+		for i, k := range in.stack {
+			if k == key {
+				cycle = append(cycle, in.stack[i:]...)
+				break
+			}
+		}
+		return "", &CycleError{append(cycle, key)}
+	}
+
+	in.visiting[key] = true
+	in.stack = append(in.stack, key)
+
+	s, err := in.expand(key, in.env[key].(string))
+
+	in.stack = in.stack[:len(in.stack)-1]
+	delete(in.visiting, key)
+
+	if err != nil {
+		return "", err
+	}
+
+	in.resolved[key] = s
+	return s, nil
+}
+
+func (in *interpolator) lookup(key string) (string, bool, error) {
+	if v, ok := in.env[key]; ok && v != nil {
+		if _, isString := v.(string); isString {
+			s, err := in.resolveKey(key)
+			return s, true, err
+		}
+		return stringValue(v), true, nil
+	}
+
+	if in.options.ProcessEnv {
+		s, ok := os.LookupEnv(key)
+		return s, ok, nil
+	}
+
+	return "", false, nil
+}
+
+func (in *interpolator) expand(key, s string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+
+		if s[i+1] != '{' {
+			b.WriteByte('$')
+			continue
+		}
+
+		end := closingBrace(s, i+2)
+		if end == -1 {
+			return "", &InterpolationSyntaxError{key, i}
+		}
+
+		ref := s[i+2 : end]
+		name, defaultVal, hasDefault := ref, "", false
+		if idx := strings.Index(ref, ":-"); idx != -1 {
+			name, defaultVal, hasDefault = ref[:idx], ref[idx+2:], true
+		}
+
+		if name == "" {
+			return "", &InterpolationSyntaxError{key, i}
+		}
+
+		val, found, err := in.lookup(name)
+		if err != nil {
+			return "", err
+		}
+
+		if hasDefault && (!found || val == "") {
+			val, err = in.expand(key, defaultVal)
+			if err != nil {
+				return "", err
+			}
+		} else if !found {
+			return "", &UndefinedReferenceError{key, name}
+		}
+
+		b.WriteString(val)
+		i = end
+	}
+
+	return b.String(), nil
+}
+
+func stringValue(v interface{}) string {
+	switch val := v.(type) {
+	case json.Number:
+		return val.String()
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		if b, err := json.Marshal(val); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// closingBrace finds the brace closing a reference that starts at start,
+// allowing nested references in defaults.
+func closingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
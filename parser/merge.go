@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Sources of a merged env key.
+const (
+	EnvSourceBase        = "base"
+	EnvSourceInheritance = "inheritance"
+)
+
+// MergedEnv is a base env with inheritance overrides applied. Sources maps
+// each key of Env to where its value came from, and Deleted lists the base
+// keys that overrides removed.
+type MergedEnv struct {
+	Env     *Env
+	Sources map[string]string
+	Deleted []string
+}
+
+// Merge applies overrides on top of base without modifying either. An
+// overridden key keeps its position in base and new keys follow in the order
+// of overrides. A nil or empty overrides leaves base as is.
+//
+// An override with a null value deletes the key, so an environment can remove
+// a key it inherits rather than only replace it. The key is then missing from
+// the env altogether, where previously it was set to null, and listed in
+// Deleted. A null override of a key that isn't in base is ignored.
+func Merge(base, overrides *Env) *MergedEnv {
+	merged := &MergedEnv{Sources: make(map[string]string)}
+
+	if base == nil {
+		merged.Env = NewEnv()
+	} else {
+		merged.Env = base.clone()
+	}
+	for _, k := range merged.Env.keys {
+		merged.Sources[k] = EnvSourceBase
+	}
+
+	if overrides == nil {
+		return merged
+	}
+
+	for _, k := range overrides.keys {
+		v := overrides.values[k]
+		if isNull(v) {
+			if _, ok := merged.Env.values[k]; ok {
+				merged.Env.Delete(k)
+				delete(merged.Sources, k)
+				merged.Deleted = append(merged.Deleted, k)
+			}
+			continue
+		}
+		merged.Env.Set(k, v)
+		merged.Sources[k] = EnvSourceInheritance
+	}
+
+	return merged
+}
+
+// Source returns where key's value came from, or an empty string if key isn't
+// in the merged env.
+func (merged *MergedEnv) Source(key string) string {
+	return merged.Sources[key]
+}
+
+// KeysFrom returns the keys whose value came from source, in env order.
+func (merged *MergedEnv) KeysFrom(source string) []string {
+	var keys []string
+	for _, k := range merged.Env.keys {
+		if merged.Sources[k] == source {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func isNull(v json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(v), []byte("null"))
+}
+
+// parseOverrides reads decrypted inheritance overrides, which may be empty or
+// null when there's nothing to override.
+func parseOverrides(data []byte) (*Env, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return NewEnv(), nil
+	}
+	return ParseEnv(trimmed)
+}
@@ -3,11 +3,12 @@ package parser
 import (
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/envkey/envkey-fetch/crypto"
 	"github.com/envkey/envkey-fetch/trust"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
 type EnvServiceResponse struct {
@@ -62,6 +63,43 @@ func (response *EnvServiceResponse) validateInheritanceOverrides() error {
 }
 
 func (response *EnvServiceResponse) Parse(pw string) (string, error) {
+	decryptedVerified, err := response.ParseDecrypted(pw)
+	if err != nil {
+		return "", err
+	}
+
+	return decryptedVerified.ToJson()
+}
+
+func (response *EnvServiceResponse) ParseDecrypted(pw string) (*DecryptedVerifiedResponse, error) {
+	return response.ParseDecryptedAt(pw, time.Now())
+}
+
+// ParseDecryptedAt verifies keys, the trust chain and signatures as of now,
+// e.g. to check a cached response as of the time it was fetched.
+func (response *EnvServiceResponse) ParseDecryptedAt(pw string, now time.Time) (*DecryptedVerifiedResponse, error) {
+	return response.ParseDecryptedWithOptions(pw, ParseOptions{CurrentTime: now})
+}
+
+type ParseOptions struct {
+	// CurrentTime is the time keys and signatures are evaluated at. If zero,
+	// the current time is used.
+	CurrentTime time.Time
+
+	// PinnedRoots, if set, requires the signers' trust chains to end at one
+	// of these roots.
+	PinnedRoots trust.Pins
+
+	// VerifiedLinks, if set, skips re-verifying invitations it already holds
+	// and records newly verified ones.
+	VerifiedLinks *trust.VerifiedLinks
+
+	// MaxTrustDepth bounds the number of invitations followed from a signer
+	// to its root. If zero, trust.DefaultMaxDepth is used.
+	MaxTrustDepth int
+}
+
+func (response *EnvServiceResponse) ParseDecryptedWithOptions(pw string, options ParseOptions) (*DecryptedVerifiedResponse, error) {
 	var err error
 	var responseWithKeys *ResponseWithKeys
 	var responseWithTrustChain *ResponseWithTrustChain
@@ -69,25 +107,69 @@ func (response *EnvServiceResponse) Parse(pw string) (string, error) {
 
 	err = response.validate()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if options.CurrentTime.IsZero() {
+		options.CurrentTime = time.Now()
 	}
+	now := options.CurrentTime
 
+	start := time.Now()
 	responseWithKeys, err = response.parseKeys(pw)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	keyParsing := time.Since(start)
 
-	responseWithTrustChain, err = responseWithKeys.parseTrustChain()
+	start = time.Now()
+	responseWithTrustChain, err = responseWithKeys.parseTrustChain(options)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	trustChain := time.Since(start)
 
-	decryptedVerified, err = responseWithTrustChain.decryptAndVerify()
+	decryptedVerified, err = responseWithTrustChain.decryptAndVerify(now)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	decryptedVerified.Timings.KeyParsing = keyParsing
+	decryptedVerified.Timings.TrustChain += trustChain
+
+	return decryptedVerified, nil
+}
+
+// TrustGraph verifies the response's keys and returns the invite graph of its
+// trusted keys, without decrypting the env.
+func (response *EnvServiceResponse) TrustGraph(pw string, options ParseOptions) (*trust.Graph, error) {
+	var err error
+	var responseWithKeys *ResponseWithKeys
+	var responseWithTrustChain *ResponseWithTrustChain
+
+	err = response.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.CurrentTime.IsZero() {
+		options.CurrentTime = time.Now()
+	}
+
+	responseWithKeys, err = response.parseKeys(pw)
+	if err != nil {
+		return nil, err
 	}
 
-	return decryptedVerified.toJson()
+	responseWithTrustChain, err = responseWithKeys.parseTrustChain(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseWithTrustChain.TrustedKeyablesChain.Graph(
+		responseWithTrustChain.Signer,
+		responseWithTrustChain.InheritanceOverridesSigner,
+	), nil
 }
 
 func (response *EnvServiceResponse) parseKeys(pw string) (*ResponseWithKeys, error) {
@@ -104,7 +186,7 @@ func (response *EnvServiceResponse) parseKeys(pw string) (*ResponseWithKeys, err
 		return nil, err
 	}
 
-	err = crypto.VerifyPubkeyWithPrivkey(verifiedPubkey, decryptedPrivkey)
+	privkey, err := crypto.VerifiedPrivkey(verifiedPubkey, decryptedPrivkey)
 	if err != nil {
 		return nil, err
 	}
@@ -125,10 +207,10 @@ func (response *EnvServiceResponse) parseKeys(pw string) (*ResponseWithKeys, err
 		RawResponse:                        response,
 		DecryptedPrivkey:                   decryptedPrivkey,
 		VerifiedPubkey:                     verifiedPubkey,
-		SignerKeyring:                      append(decryptedPrivkey, signedByPubkey...),
+		SignerKeyring:                      append(openpgp.EntityList{privkey}, signedByPubkey...),
 		SignedByPubkey:                     signedByPubkey,
 		InheritanceOverridesSignedByPubkey: inheritanceOverridesSignedByPubkey,
-		InheritanceSignerKeyring:           append(decryptedPrivkey, inheritanceOverridesSignedByPubkey...),
+		InheritanceSignerKeyring:           append(openpgp.EntityList{privkey}, inheritanceOverridesSignedByPubkey...),
 	}
 
 	return &responseWithKeys, nil
@@ -145,10 +227,10 @@ func (response *ResponseWithKeys) hasInheritanceOverrides() bool {
 
 func (response *ResponseWithKeys) signer() *trust.Signer {
 	return &trust.Signer{
-		response.RawResponse.SignedById,
-		response.RawResponse.SignedByPubkeyArmored,
-		response.SignedByPubkey,
-		false,
+		Id:                  response.RawResponse.SignedById,
+		PubkeyArmored:       response.RawResponse.SignedByPubkeyArmored,
+		Pubkey:              response.SignedByPubkey,
+		IsInheritanceSigner: false,
 	}
 }
 
@@ -157,23 +239,24 @@ func (response *ResponseWithKeys) inheritanceOverridesSigner() *trust.Signer {
 		return nil
 	}
 	return &trust.Signer{
-		response.RawResponse.InheritanceOverridesSignedById,
-		response.RawResponse.InheritanceOverridesSignedByPubkeyArmored,
-		response.InheritanceOverridesSignedByPubkey,
-		true,
+		Id:                  response.RawResponse.InheritanceOverridesSignedById,
+		PubkeyArmored:       response.RawResponse.InheritanceOverridesSignedByPubkeyArmored,
+		Pubkey:              response.InheritanceOverridesSignedByPubkey,
+		IsInheritanceSigner: true,
 	}
 }
 
-func (response *ResponseWithKeys) trustedKeyablesChain() (*trust.TrustedKeyablesChain, error) {
+func (response *ResponseWithKeys) trustedKeyablesChain(options ParseOptions) (*trust.TrustedKeyablesChain, error) {
 	var err error
+	now := options.CurrentTime
 	var creatorTrusted, signerTrusted, inheritanceOverridesTrusted trust.TrustedKeyablesMap
 
-	creatorTrusted, err = parseTrustedKeys(response.RawResponse.SignedTrustedPubkeys, response.VerifiedPubkey)
+	creatorTrusted, err = parseTrustedKeys(response.RawResponse.SignedTrustedPubkeys, response.VerifiedPubkey, now)
 	if err != nil {
 		return nil, err
 	}
 
-	signerTrusted, err = parseTrustedKeys(response.RawResponse.SignedByTrustedPubkeys, response.SignedByPubkey)
+	signerTrusted, err = parseTrustedKeys(response.RawResponse.SignedByTrustedPubkeys, response.SignedByPubkey, now)
 	if err != nil {
 		return nil, err
 	}
@@ -182,27 +265,36 @@ func (response *ResponseWithKeys) trustedKeyablesChain() (*trust.TrustedKeyables
 		inheritanceOverridesTrusted, err = parseTrustedKeys(
 			response.RawResponse.InheritanceOverridesSignedByTrustedPubkeys,
 			response.InheritanceOverridesSignedByPubkey,
+			now,
 		)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	trustedChain := trust.TrustedKeyablesChain{creatorTrusted, signerTrusted, inheritanceOverridesTrusted}
+	trustedChain := trust.TrustedKeyablesChain{
+		CreatorTrusted:                    creatorTrusted,
+		SignerTrusted:                     signerTrusted,
+		InheritanceOverridesSignerTrusted: inheritanceOverridesTrusted,
+		CurrentTime:                       now,
+		PinnedRoots:                       options.PinnedRoots,
+		VerifiedLinks:                     options.VerifiedLinks,
+		MaxDepth:                          options.MaxTrustDepth,
+	}
 
 	return &trustedChain, nil
 }
 
-func (response *ResponseWithKeys) parseTrustChain() (*ResponseWithTrustChain, error) {
-	trustedKeyablesChain, err := response.trustedKeyablesChain()
+func (response *ResponseWithKeys) parseTrustChain(options ParseOptions) (*ResponseWithTrustChain, error) {
+	trustedKeyablesChain, err := response.trustedKeyablesChain(options)
 	if err != nil {
 		return nil, err
 	}
 
 	responseWithTrustChain := ResponseWithTrustChain{
-		ResponseWithKeys:     response,
-		TrustedKeyablesChain: trustedKeyablesChain,
-		Signer:               response.signer(),
+		ResponseWithKeys:           response,
+		TrustedKeyablesChain:       trustedKeyablesChain,
+		Signer:                     response.signer(),
 		InheritanceOverridesSigner: response.inheritanceOverridesSigner(),
 	}
 
@@ -220,112 +312,159 @@ func (response *ResponseWithTrustChain) hasInheritanceOverrides() bool {
 	return response.ResponseWithKeys.hasInheritanceOverrides()
 }
 
-func (response *ResponseWithTrustChain) verifyTrusted(signer *trust.Signer) error {
-	trusted, _, err := response.TrustedKeyablesChain.SignerTrustedKeyable(signer)
+// verifyTrusted returns an explanation of the signer's trust chain. Errors
+// are wrapped in a trust.ExplainedError so callers can show where it broke.
+func (response *ResponseWithTrustChain) verifyTrusted(signer *trust.Signer) (*trust.Explanation, error) {
+	trusted, _, explanation, err := response.TrustedKeyablesChain.SignerTrustedKeyable(signer)
 
 	if err != nil {
-		return err
+		return nil, &trust.ExplainedError{Err: err, Explanation: explanation}
 	} else if trusted == nil {
-		return errors.New("Signer not trusted.")
+		return nil, &trust.ExplainedError{Err: errors.New("Signer not trusted."), Explanation: explanation}
 	}
 
-	return nil
+	return explanation, nil
 }
 
-func (response *ResponseWithTrustChain) decryptAndVerify() (*DecryptedVerifiedResponse, error) {
+func (response *ResponseWithTrustChain) decryptAndVerify(now time.Time) (*DecryptedVerifiedResponse, error) {
 	var err error
+	var signerExplanation, inheritanceOverridesSignerExplanation *trust.Explanation
+
+	start := time.Now()
 
 	// verify signer trusted
-	err = response.verifyTrusted(response.Signer)
+	signerExplanation, err = response.verifyTrusted(response.Signer)
 	if err != nil {
 		return nil, err
 	}
 
 	// verify inheritance overrides signer trusted
 	if response.hasInheritanceOverrides() {
-		err = response.verifyTrusted(response.InheritanceOverridesSigner)
+		inheritanceOverridesSignerExplanation, err = response.verifyTrusted(response.InheritanceOverridesSigner)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	decryptedVerifiedResponse := new(DecryptedVerifiedResponse)
+	decryptedVerifiedResponse := &DecryptedVerifiedResponse{
+		Signer:                                response.Signer,
+		InheritanceOverridesSigner:            response.InheritanceOverridesSigner,
+		SignerExplanation:                     signerExplanation,
+		InheritanceOverridesSignerExplanation: inheritanceOverridesSignerExplanation,
+	}
+	decryptedVerifiedResponse.Timings.TrustChain = time.Since(start)
+
+	start = time.Now()
 
 	// decrypt env
 	var decryptedEnvBytes []byte
-	decryptedEnvBytes, err = crypto.DecryptAndVerify(
+	decryptedEnvBytes, err = crypto.DecryptAndVerifyAt(
 		[]byte(response.ResponseWithKeys.RawResponse.Env),
 		response.ResponseWithKeys.SignerKeyring,
+		now,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	decryptedVerifiedResponse.DecryptedEnv, err = ParseEnv(decryptedEnvBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	if response.hasInheritanceOverrides() {
 		var decryptedInheritanceBytes []byte
-		decryptedInheritanceBytes, err = crypto.DecryptAndVerify(
+		decryptedInheritanceBytes, err = crypto.DecryptAndVerifyAt(
 			[]byte(response.ResponseWithKeys.RawResponse.InheritanceOverrides),
 			response.ResponseWithKeys.InheritanceSignerKeyring,
+			now,
 		)
 		if err != nil {
 			return nil, err
 		}
 
-		var env, inheritanceOverrides map[string]interface{}
-		err = json.Unmarshal(decryptedEnvBytes, &env)
+		decryptedVerifiedResponse.DecryptedInheritanceOverrides, err = parseOverrides(decryptedInheritanceBytes)
 		if err != nil {
 			return nil, err
 		}
-		err = json.Unmarshal(decryptedInheritanceBytes, &inheritanceOverrides)
-		if err != nil {
-			return nil, err
-		}
-
-		decryptedVerifiedResponse.DecryptedEnv = env
-		decryptedVerifiedResponse.DecryptedInheritanceOverrides = inheritanceOverrides
-	} else {
-		decryptedVerifiedResponse.DecryptedEnvString = string(decryptedEnvBytes)
 	}
 
+	decryptedVerifiedResponse.Timings.Decryption = time.Since(start)
+
 	return decryptedVerifiedResponse, nil
 }
 
+type Timings struct {
+	KeyParsing time.Duration
+	TrustChain time.Duration
+	Decryption time.Duration
+}
+
 type DecryptedVerifiedResponse struct {
-	DecryptedEnvString            string
-	DecryptedEnv                  map[string]interface{}
-	DecryptedInheritanceOverrides map[string]interface{}
+	DecryptedEnv                  *Env
+	DecryptedInheritanceOverrides *Env
+	InterpolatedEnv               *Env
+	Signer                        *trust.Signer
+	InheritanceOverridesSigner    *trust.Signer
+	Timings                       Timings
+
+	// Explanations of the trust chains verified for each signer.
+	SignerExplanation                     *trust.Explanation
+	InheritanceOverridesSignerExplanation *trust.Explanation
 }
 
-func (response *DecryptedVerifiedResponse) toJson() (string, error) {
-	if response.DecryptedEnvString == "" {
-		envJson, err := json.Marshal(response.toMap())
-		if err != nil {
-			return "", err
-		}
-		return string(envJson), nil
-	} else {
-		return response.DecryptedEnvString, nil
+func (response *DecryptedVerifiedResponse) HasInheritanceOverrides() bool {
+	return response.DecryptedInheritanceOverrides != nil
+}
+
+// Merged returns the decrypted env with any inheritance overrides applied,
+// along with the source of each key.
+func (response *DecryptedVerifiedResponse) Merged() *MergedEnv {
+	return Merge(response.DecryptedEnv, response.DecryptedInheritanceOverrides)
+}
+
+// Env returns the decrypted env with any inheritance overrides applied, or
+// the interpolated env once Interpolate has been called.
+func (response *DecryptedVerifiedResponse) Env() *Env {
+	if response.InterpolatedEnv != nil {
+		return response.InterpolatedEnv
 	}
+	return response.Merged().Env
 }
 
-func (response *DecryptedVerifiedResponse) toMap() map[string]interface{} {
-	if response.DecryptedEnvString != "" || response.DecryptedEnv == nil || response.DecryptedInheritanceOverrides == nil {
-		return nil
+func (response *DecryptedVerifiedResponse) ToJson() (string, error) {
+	envJson, err := json.Marshal(response.Env())
+	if err != nil {
+		return "", err
 	}
-	env := response.DecryptedEnv
-	for k, v := range response.DecryptedInheritanceOverrides {
-		env[k] = v
+	return string(envJson), nil
+}
+
+// EnvMap returns the decrypted env as a map, with any inheritance overrides
+// applied. Numbers are json.Number.
+func (response *DecryptedVerifiedResponse) EnvMap() (map[string]interface{}, error) {
+	return response.Env().Map(), nil
+}
+
+// Interpolate expands references between env values. The result is used
+// by Env, ToJson and EnvMap from then on.
+func (response *DecryptedVerifiedResponse) Interpolate(options InterpolateOptions) error {
+	interpolated, err := InterpolateEnv(response.Env(), options)
+	if err != nil {
+		return err
 	}
-	return env
+
+	response.InterpolatedEnv = interpolated
+	return nil
 }
 
-func parseTrustedKeys(rawTrusted string, signerPubkey openpgp.EntityList) (trust.TrustedKeyablesMap, error) {
+func parseTrustedKeys(rawTrusted string, signerPubkey openpgp.EntityList, now time.Time) (trust.TrustedKeyablesMap, error) {
 	var err error
 	var verified []byte
 
 	trusted := make(trust.TrustedKeyablesMap)
 
-	verified, err = crypto.VerifySignedCleartext([]byte(rawTrusted), signerPubkey)
+	verified, err = crypto.VerifySignedCleartextAt([]byte(rawTrusted), signerPubkey, now)
 	if err != nil {
 		return nil, err
 	}
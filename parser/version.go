@@ -0,0 +1,257 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// DefaultApiVersion is assumed for responses that don't declare a version.
+const DefaultApiVersion = 1
+
+// UnsupportedVersionError is returned for a response of an api version there's
+// no decoder for.
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (err *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("Unsupported api version: %d.", err.Version)
+}
+
+// responseCodec reads and writes one api version of the service response.
+// Every version decodes to the same EnvServiceResponse.
+type responseCodec struct {
+	decode func(dec *json.Decoder) (*EnvServiceResponse, error)
+	encode func(response *EnvServiceResponse) interface{}
+}
+
+var codecsMu sync.RWMutex
+
+var responseCodecs = map[int]responseCodec{
+	1: {decodeV1, encodeV1},
+}
+
+// experimentalCodecs are drafts of api versions the EnvKey host doesn't serve,
+// only registered by EnableExperimentalApiVersions.
+var experimentalCodecs = map[int]responseCodec{
+	2: {decodeV2, encodeV2},
+}
+
+// EnableExperimentalApiVersions registers the draft api versions, currently
+// v2, so they're decoded, encoded and advertised like the others, e.g. for
+// testing against a mock host. They may change before the EnvKey host serves
+// them, so they're off by default.
+func EnableExperimentalApiVersions() {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	for version, codec := range experimentalCodecs {
+		responseCodecs[version] = codec
+	}
+}
+
+func codecFor(version int) (responseCodec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := responseCodecs[version]
+	return codec, ok
+}
+
+// SupportedApiVersions lists the api versions responses can be decoded from,
+// newest first.
+func SupportedApiVersions() []int {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	versions := make([]int, 0, len(responseCodecs))
+	for version := range responseCodecs {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return versions
+}
+
+// DecodeResponse decodes a service response of any supported api version. The
+// version is options.ApiVersion if set (e.g. negotiated by a response header),
+// otherwise the api_version field of the response, otherwise
+// DefaultApiVersion. A response that declares a different version than was
+// negotiated is an error. The version decoded is returned.
+func DecodeResponse(data []byte, options DecodeOptions) (*EnvServiceResponse, int, error) {
+	declared, err := ResponseApiVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	version := options.ApiVersion
+	if version == 0 {
+		version = declared
+	} else if declared != 0 && declared != version {
+		return nil, 0, &DecodeError{fmt.Errorf("response declares api version %d but %d was negotiated.", declared, version)}
+	}
+	if version == 0 {
+		version = DefaultApiVersion
+	}
+
+	codec, ok := codecFor(version)
+	if !ok {
+		return nil, 0, &UnsupportedVersionError{version}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if options.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	response, err := codec.decode(dec)
+	if err == io.EOF {
+		return nil, 0, &DecodeError{errors.New("empty response.")}
+	} else if err != nil {
+		return nil, 0, &DecodeError{err}
+	}
+
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, 0, &DecodeError{errors.New("unexpected data after response.")}
+	}
+
+	return response, version, nil
+}
+
+// EncodeResponse writes response in the given api version.
+func EncodeResponse(response *EnvServiceResponse, version int) ([]byte, error) {
+	codec, ok := codecFor(version)
+	if !ok {
+		return nil, &UnsupportedVersionError{version}
+	}
+	return json.Marshal(codec.encode(response))
+}
+
+// ResponseApiVersion returns the api_version a response declares, or 0 if it
+// doesn't declare one.
+func ResponseApiVersion(data []byte) (int, error) {
+	var versioned struct {
+		ApiVersion *json.Number `json:"api_version"`
+	}
+	err := json.Unmarshal(data, &versioned)
+	if err != nil {
+		if _, isSyntaxErr := err.(*json.SyntaxError); isSyntaxErr || len(bytes.TrimSpace(data)) == 0 {
+			// Leave reporting malformed json to the decoder
+			return 0, nil
+		}
+		return 0, &DecodeError{err}
+	}
+	if versioned.ApiVersion == nil {
+		return 0, nil
+	}
+
+	version, err := versioned.ApiVersion.Int64()
+	if err != nil || version < 1 {
+		return 0, &DecodeError{fmt.Errorf("invalid api version %s.", versioned.ApiVersion)}
+	}
+	return int(version), nil
+}
+
+// v1 is the original flat response. It may declare its version.
+type responseV1 struct {
+	ApiVersion int `json:"api_version,omitempty"`
+	EnvServiceResponse
+}
+
+func decodeV1(dec *json.Decoder) (*EnvServiceResponse, error) {
+	var decoded responseV1
+	err := dec.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+	return &decoded.EnvServiceResponse, nil
+}
+
+func encodeV1(response *EnvServiceResponse) interface{} {
+	return response
+}
+
+// v2 is a draft that groups each encrypted payload with the envelope of its signer, and the
+// client's own keys together.
+type responseV2 struct {
+	ApiVersion           int              `json:"api_version"`
+	Keys                 keysV2           `json:"keys"`
+	Env                  signedPayloadV2  `json:"env"`
+	InheritanceOverrides *signedPayloadV2 `json:"inheritance_overrides,omitempty"`
+	AllowCaching         bool             `json:"allow_caching"`
+}
+
+type keysV2 struct {
+	EncryptedPrivkey     string `json:"encrypted_privkey"`
+	Pubkey               string `json:"pubkey"`
+	SignedTrustedPubkeys string `json:"signed_trusted_pubkeys"`
+}
+
+type signedPayloadV2 struct {
+	Ciphertext string   `json:"ciphertext"`
+	Signer     signerV2 `json:"signer"`
+}
+
+type signerV2 struct {
+	Id             string `json:"id"`
+	Pubkey         string `json:"pubkey"`
+	TrustedPubkeys string `json:"trusted_pubkeys"`
+}
+
+func decodeV2(dec *json.Decoder) (*EnvServiceResponse, error) {
+	var decoded responseV2
+	err := dec.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &EnvServiceResponse{
+		Env:                    decoded.Env.Ciphertext,
+		EncryptedPrivkey:       decoded.Keys.EncryptedPrivkey,
+		PubkeyArmored:          decoded.Keys.Pubkey,
+		SignedTrustedPubkeys:   decoded.Keys.SignedTrustedPubkeys,
+		SignedById:             decoded.Env.Signer.Id,
+		SignedByPubkeyArmored:  decoded.Env.Signer.Pubkey,
+		SignedByTrustedPubkeys: decoded.Env.Signer.TrustedPubkeys,
+		AllowCaching:           decoded.AllowCaching,
+	}
+	if overrides := decoded.InheritanceOverrides; overrides != nil {
+		response.InheritanceOverrides = overrides.Ciphertext
+		response.InheritanceOverridesSignedById = overrides.Signer.Id
+		response.InheritanceOverridesSignedByPubkeyArmored = overrides.Signer.Pubkey
+		response.InheritanceOverridesSignedByTrustedPubkeys = overrides.Signer.TrustedPubkeys
+	}
+	return response, nil
+}
+
+func encodeV2(response *EnvServiceResponse) interface{} {
+	encoded := responseV2{
+		ApiVersion: 2,
+		Keys: keysV2{
+			EncryptedPrivkey:     response.EncryptedPrivkey,
+			Pubkey:               response.PubkeyArmored,
+			SignedTrustedPubkeys: response.SignedTrustedPubkeys,
+		},
+		Env: signedPayloadV2{
+			Ciphertext: response.Env,
+			Signer: signerV2{
+				Id:             response.SignedById,
+				Pubkey:         response.SignedByPubkeyArmored,
+				TrustedPubkeys: response.SignedByTrustedPubkeys,
+			},
+		},
+		AllowCaching: response.AllowCaching,
+	}
+	if response.InheritanceOverrides != "" {
+		encoded.InheritanceOverrides = &signedPayloadV2{
+			Ciphertext: response.InheritanceOverrides,
+			Signer: signerV2{
+				Id:             response.InheritanceOverridesSignedById,
+				Pubkey:         response.InheritanceOverridesSignedByPubkeyArmored,
+				TrustedPubkeys: response.InheritanceOverridesSignedByTrustedPubkeys,
+			},
+		}
+	}
+	return encoded
+}
@@ -0,0 +1,155 @@
+package trust
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/envkey/envkey-fetch/crypto"
+)
+
+// Sources identify which map of a TrustedKeyablesChain a keyable came from.
+const (
+	SourceCreator     = "creator"
+	SourceSigner      = "signer"
+	SourceInheritance = "inheritance"
+)
+
+const (
+	CheckFingerprint     = "fingerprint matches trusted key"
+	CheckKeyValid        = "signer key valid"
+	CheckInviteSignature = "invite key certified by inviter"
+	CheckPubkeySignature = "pubkey certified by invite key"
+	CheckPinned          = "pinned root"
+)
+
+// Check is the outcome of a check. Memoized checks passed on an earlier
+// verification recorded in VerifiedLinks and weren't repeated.
+type Check struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Memoized bool   `json:"memoized,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Step is a keyable visited while verifying a signer. Source is empty when the
+// id couldn't be found in any of the chain's maps.
+type Step struct {
+	Id          string  `json:"id"`
+	Source      string  `json:"source,omitempty"`
+	Fingerprint string  `json:"fingerprint,omitempty"`
+	InvitedById string  `json:"invitedById,omitempty"`
+	Root        bool    `json:"root,omitempty"`
+	Checks      []Check `json:"checks,omitempty"`
+}
+
+// Explanation records the path walked from a signer to its trusted root, the
+// checks made along the way and, if verification failed, where it broke.
+type Explanation struct {
+	SignerId            string  `json:"signerId"`
+	IsInheritanceSigner bool    `json:"isInheritanceSigner"`
+	Trusted             bool    `json:"trusted"`
+	Path                []*Step `json:"path"`
+	BrokenAt            string  `json:"brokenAt,omitempty"`
+	Error               string  `json:"error,omitempty"`
+}
+
+// ExplainedError carries the explanation of a failed verification alongside
+// the error itself.
+type ExplainedError struct {
+	Err         error
+	Explanation *Explanation
+}
+
+func (err *ExplainedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ExplainedError) Unwrap() error {
+	return err.Err
+}
+
+func (explanation *Explanation) String() string {
+	var b strings.Builder
+
+	role := "env signer"
+	if explanation.IsInheritanceSigner {
+		role = "inheritance overrides signer"
+	}
+	status := "trusted"
+	if !explanation.Trusted {
+		status = "NOT trusted"
+	}
+	fmt.Fprintf(&b, "%s %s: %s\n", role, explanation.SignerId, status)
+
+	for _, step := range explanation.Path {
+		source := step.Source
+		if source == "" {
+			source = "not found"
+		}
+		fmt.Fprintf(&b, "  %s (%s)", step.Id, source)
+		if step.Root {
+			b.WriteString(" root")
+		}
+		b.WriteString("\n")
+
+		if step.Fingerprint != "" {
+			fmt.Fprintf(&b, "    fingerprint: %s\n", step.Fingerprint)
+		}
+		if step.InvitedById != "" {
+			fmt.Fprintf(&b, "    invited by: %s\n", step.InvitedById)
+		}
+		for _, check := range step.Checks {
+			if check.Memoized {
+				fmt.Fprintf(&b, "    ok: %s (memoized)\n", check.Name)
+			} else if check.Passed {
+				fmt.Fprintf(&b, "    ok: %s\n", check.Name)
+			} else {
+				fmt.Fprintf(&b, "    FAILED: %s: %s\n", check.Name, check.Error)
+			}
+		}
+	}
+
+	if explanation.BrokenAt != "" {
+		fmt.Fprintf(&b, "  chain broke at %s: %s\n", explanation.BrokenAt, explanation.Error)
+	}
+
+	return b.String()
+}
+
+func (explanation *Explanation) step(id, source string, keyable *TrustedKeyable) *Step {
+	step := &Step{Id: id, Source: source}
+	if keyable != nil {
+		step.Fingerprint = keyableFingerprint(keyable)
+		step.InvitedById = keyable.InvitedById
+	}
+	explanation.Path = append(explanation.Path, step)
+	return step
+}
+
+// fail records where the chain broke and returns err.
+func (explanation *Explanation) fail(id string, err error) error {
+	explanation.BrokenAt = id
+	explanation.Error = err.Error()
+	return err
+}
+
+// check records the outcome of a check and returns err.
+func (step *Step) check(name string, err error) error {
+	check := Check{Name: name, Passed: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	step.Checks = append(step.Checks, check)
+	return err
+}
+
+// keyableFingerprint returns the hex encoded primary key fingerprint, or an
+// empty string if the pubkey can't be read.
+func keyableFingerprint(keyable *TrustedKeyable) string {
+	pubkey, err := crypto.ReadArmoredKey([]byte(keyable.PubkeyArmored))
+	if err != nil || len(pubkey) == 0 || pubkey[0].PrimaryKey == nil {
+		return ""
+	}
+	return hex.EncodeToString(pubkey[0].PrimaryKey.Fingerprint)
+}
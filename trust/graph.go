@@ -0,0 +1,207 @@
+package trust
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Node is a keyable in the invite graph. Sources lists each map of the chain
+// it appears in, and is empty for an inviter that isn't in any of them.
+type Node struct {
+	Id                string   `json:"id"`
+	Fingerprint       string   `json:"fingerprint,omitempty"`
+	Sources           []string `json:"sources"`
+	Root              bool     `json:"root"`
+	Pinned            bool     `json:"pinned,omitempty"`
+	Signer            bool     `json:"signer,omitempty"`
+	InheritanceSigner bool     `json:"inheritanceSigner,omitempty"`
+	Trusted           bool     `json:"trusted"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// Edge is an invitation: From was invited by To. Source is the map the
+// invited keyable was found in.
+type Edge struct {
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Source   string  `json:"source"`
+	Verified bool    `json:"verified"`
+	Checks   []Check `json:"checks,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Graph is the web of trust formed by the maps of a TrustedKeyablesChain.
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+}
+
+// Graph builds the invite graph of every keyable in the chain, verifying each
+// invitation and whether each keyable leads back to a trusted root as of the
+// chain's CurrentTime. Signers are marked on their nodes.
+func (trustedKeyables *TrustedKeyablesChain) Graph(signers ...*Signer) *Graph {
+	now := trustedKeyables.now()
+	graph := &Graph{}
+	nodes := make(map[string]*Node)
+
+	node := func(id string) *Node {
+		n, ok := nodes[id]
+		if !ok {
+			n = &Node{Id: id, Sources: []string{}}
+			nodes[id] = n
+			graph.Nodes = append(graph.Nodes, n)
+		}
+		return n
+	}
+
+	sources := []struct {
+		name     string
+		keyables TrustedKeyablesMap
+	}{
+		{SourceCreator, trustedKeyables.CreatorTrusted},
+		{SourceSigner, trustedKeyables.SignerTrusted},
+		{SourceInheritance, trustedKeyables.InheritanceOverridesSignerTrusted},
+	}
+
+	for _, source := range sources {
+		for _, id := range sortedIds(source.keyables) {
+			keyable := source.keyables[id]
+			n := node(id)
+			n.Sources = append(n.Sources, source.name)
+			if n.Fingerprint == "" {
+				n.Fingerprint = keyableFingerprint(&keyable)
+			}
+
+			if source.name == SourceCreator {
+				n.Root = true
+				n.Trusted = true
+				if len(trustedKeyables.PinnedRoots) > 0 {
+					n.Pinned, _ = trustedKeyables.PinnedRoots.Matches(id, &keyable)
+				}
+				continue
+			}
+
+			// A keyable that is also creator trusted is already a root
+			if !n.Root {
+				explanation := &Explanation{}
+				explanation.step(id, source.name, &keyable)
+				_, _, _, err := source.keyables.trustedRoot(&keyable, newChainWalk(trustedKeyables.CreatorTrusted, now, source.name, explanation, nil, trustedKeyables.MaxDepth))
+				if err == nil {
+					n.Trusted = true
+					n.Error = ""
+				} else if !n.Trusted {
+					n.Error = err.Error()
+				}
+			}
+
+			if keyable.InvitedById == "" {
+				continue
+			}
+
+			edge := &Edge{From: id, To: keyable.InvitedById, Source: source.name}
+			graph.Edges = append(graph.Edges, edge)
+
+			inviter, ok := trustedKeyables.CreatorTrusted[keyable.InvitedById]
+			if !ok {
+				inviter, ok = source.keyables[keyable.InvitedById]
+			}
+			if !ok {
+				node(keyable.InvitedById)
+				edge.Error = "Inviter not trusted."
+				continue
+			}
+
+			step := &Step{}
+			_, err := keyable.verifyInviter(&inviter, now, step)
+			edge.Verified = err == nil
+			edge.Checks = step.Checks
+			if err != nil {
+				edge.Error = err.Error()
+			}
+		}
+	}
+
+	for _, signer := range signers {
+		if signer == nil {
+			continue
+		}
+		n := node(signer.Id)
+		if signer.IsInheritanceSigner {
+			n.InheritanceSigner = true
+		} else {
+			n.Signer = true
+		}
+	}
+
+	return graph
+}
+
+// DOT renders the graph in Graphviz format. Roots are drawn with a double
+// border, signers in bold, and invitations that failed verification as dashed
+// red edges labeled with the error.
+func (graph *Graph) DOT() string {
+	var b strings.Builder
+
+	b.WriteString("digraph trust {\n")
+	b.WriteString("  rankdir=BT;\n")
+	b.WriteString("  node [shape=box];\n")
+
+	for _, n := range graph.Nodes {
+		label := n.Id
+		if n.Fingerprint != "" {
+			label += "\n" + n.Fingerprint
+		}
+		if len(n.Sources) > 0 {
+			label += "\n" + strings.Join(n.Sources, ", ")
+		} else {
+			label += "\nnot found"
+		}
+
+		attrs := []string{"label=" + dotQuote(label)}
+		var styles []string
+		if n.Root {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if n.Signer || n.InheritanceSigner {
+			styles = append(styles, "bold")
+		}
+		if !n.Trusted {
+			attrs = append(attrs, "color=red")
+			styles = append(styles, "dashed")
+		} else if n.Pinned {
+			attrs = append(attrs, "color=blue")
+		}
+		if len(styles) > 0 {
+			attrs = append(attrs, "style="+dotQuote(strings.Join(styles, ",")))
+		}
+		fmt.Fprintf(&b, "  %s [%s];\n", dotQuote(n.Id), strings.Join(attrs, ", "))
+	}
+
+	for _, e := range graph.Edges {
+		if e.Verified {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s, color=darkgreen];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Source))
+		} else {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s, color=red, style=dashed];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Source+": "+e.Error))
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+func sortedIds(trustedKeyables TrustedKeyablesMap) []string {
+	ids := make([]string, 0, len(trustedKeyables))
+	for id := range trustedKeyables {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
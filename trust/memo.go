@@ -0,0 +1,157 @@
+package trust
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrVerifiedLinksTampered = errors.New("Verified links failed authentication.")
+
+// VerifiedLink records that an invitation verified. Digest covers the inviter's
+// pubkey and the invitee's invite key and pubkey, so a link is re-verified if
+// any of them change (e.g. a revocation is added). The link holds from
+// VerifiedAt until ValidUntil, or indefinitely if ValidUntil is zero.
+type VerifiedLink struct {
+	Digest     string    `json:"digest"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+	ValidUntil time.Time `json:"validUntil"`
+}
+
+// VerifiedLinks memoizes successfully verified inviter to invitee links, keyed
+// by the pair of fingerprints, so repeated verification of the same trust
+// chain can skip signature checks. It is safe for concurrent use.
+type VerifiedLinks struct {
+	mutex sync.Mutex
+	links map[string]VerifiedLink
+}
+
+type signedVerifiedLinks struct {
+	Links json.RawMessage `json:"links"`
+	Mac   string          `json:"mac"`
+}
+
+func NewVerifiedLinks() *VerifiedLinks {
+	return &VerifiedLinks{links: make(map[string]VerifiedLink)}
+}
+
+// UnmarshalVerifiedLinks reads links written by MarshalSigned, checking they
+// were signed with the same secret.
+func UnmarshalVerifiedLinks(data, secret []byte) (*VerifiedLinks, error) {
+	var signed signedVerifiedLinks
+	err := json.Unmarshal(data, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := hex.DecodeString(signed.Mac)
+	if err != nil || !hmac.Equal(mac, linksMac(signed.Links, secret)) {
+		return nil, ErrVerifiedLinksTampered
+	}
+
+	links := NewVerifiedLinks()
+	err = json.Unmarshal(signed.Links, &links.links)
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// MarshalSigned serializes the links that haven't expired, authenticated with
+// secret. A persisted memo lets verification be skipped, so it must only be
+// trusted if it was written by someone holding the secret.
+func (links *VerifiedLinks) MarshalSigned(secret []byte) ([]byte, error) {
+	links.mutex.Lock()
+	unexpired := make(map[string]VerifiedLink)
+	now := time.Now()
+	for key, link := range links.links {
+		if link.ValidUntil.IsZero() || now.Before(link.ValidUntil) {
+			unexpired[key] = link
+		}
+	}
+	links.mutex.Unlock()
+
+	linksJson, err := json.Marshal(unexpired)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(signedVerifiedLinks{linksJson, hex.EncodeToString(linksMac(linksJson, secret))})
+}
+
+// Merge adds other's links, keeping the existing link where both have one.
+func (links *VerifiedLinks) Merge(other *VerifiedLinks) {
+	if links == other {
+		return
+	}
+	other.mutex.Lock()
+	defer other.mutex.Unlock()
+	links.mutex.Lock()
+	defer links.mutex.Unlock()
+
+	for key, link := range other.links {
+		if _, ok := links.links[key]; !ok {
+			links.links[key] = link
+		}
+	}
+}
+
+func (links *VerifiedLinks) Len() int {
+	links.mutex.Lock()
+	defer links.mutex.Unlock()
+	return len(links.links)
+}
+
+// verifyInviter verifies keyable's invitation by inviter, skipping the
+// signature checks if the same link was already verified and still holds at
+// now. A nil memo always verifies.
+func (links *VerifiedLinks) verifyInviter(keyable, inviter *TrustedKeyable, fingerprint, inviterFingerprint string, now time.Time, step *Step) error {
+	if links == nil || fingerprint == "" || inviterFingerprint == "" {
+		_, err := keyable.verifyInviter(inviter, now, step)
+		return err
+	}
+
+	key := inviterFingerprint + ":" + fingerprint
+	digest := linkDigest(keyable, inviter)
+
+	links.mutex.Lock()
+	link, ok := links.links[key]
+	links.mutex.Unlock()
+
+	if ok && link.Digest == digest && !now.Before(link.VerifiedAt) && (link.ValidUntil.IsZero() || now.Before(link.ValidUntil)) {
+		step.Checks = append(step.Checks,
+			Check{Name: CheckInviteSignature, Passed: true, Memoized: true},
+			Check{Name: CheckPubkeySignature, Passed: true, Memoized: true},
+		)
+		return nil
+	}
+
+	validUntil, err := keyable.verifyInviter(inviter, now, step)
+	if err != nil {
+		return err
+	}
+
+	links.mutex.Lock()
+	links.links[key] = VerifiedLink{Digest: digest, VerifiedAt: now, ValidUntil: validUntil}
+	links.mutex.Unlock()
+	return nil
+}
+
+func linkDigest(keyable, inviter *TrustedKeyable) string {
+	hash := sha256.New()
+	for _, armored := range []string{inviter.PubkeyArmored, keyable.InvitePubkeyArmored, keyable.PubkeyArmored} {
+		hash.Write([]byte(armored))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func linksMac(linksJson, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(linksJson)
+	return mac.Sum(nil)
+}
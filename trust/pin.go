@@ -0,0 +1,107 @@
+package trust
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/envkey/envkey-fetch/crypto"
+)
+
+var ErrRootNotPinned = errors.New("Trust chain does not end at a pinned root.")
+
+// Pin identifies a root signer that's allowed to anchor the trust chain.
+// Fingerprint is the hex encoded fingerprint of the signer's primary key;
+// spaces and colons are ignored.
+type Pin struct {
+	Id          string `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type Pins []Pin
+
+// PinFile maps envkey ids (the part of an ENVKEY before the first dash) to
+// their pinned roots.
+type PinFile map[string]Pins
+
+func ReadPinFile(path string) (PinFile, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pinFile PinFile
+	err = json.Unmarshal(raw, &pinFile)
+	if err != nil {
+		return nil, errors.New("Invalid pin file: " + err.Error())
+	}
+
+	for _, pins := range pinFile {
+		for _, pin := range pins {
+			err = pin.validate()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return pinFile, nil
+}
+
+// ParsePin parses a pin in ID=FINGERPRINT form.
+func ParsePin(s string) (Pin, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return Pin{}, errors.New("Pin must be in ID=FINGERPRINT form: " + s)
+	}
+
+	pin := Pin{strings.TrimSpace(parts[0]), parts[1]}
+	return pin, pin.validate()
+}
+
+func (pin Pin) validate() error {
+	if pin.Id == "" {
+		return errors.New("Pin is missing an id.")
+	}
+
+	fingerprint := normalizeFingerprint(pin.Fingerprint)
+	if _, err := hex.DecodeString(fingerprint); err != nil || fingerprint == "" {
+		return errors.New("Pin fingerprint for " + pin.Id + " is not hex encoded.")
+	}
+
+	return nil
+}
+
+// Matches checks whether the keyable with the given id is pinned by both id
+// and primary key fingerprint.
+func (pins Pins) Matches(id string, keyable *TrustedKeyable) (bool, error) {
+	var fingerprint string
+
+	for _, pin := range pins {
+		if pin.Id != id {
+			continue
+		}
+
+		if fingerprint == "" {
+			pubkey, err := crypto.ReadArmoredKey([]byte(keyable.PubkeyArmored))
+			if err != nil {
+				return false, err
+			} else if len(pubkey) == 0 || pubkey[0].PrimaryKey == nil {
+				return false, errors.New("No public key found.")
+			}
+			fingerprint = hex.EncodeToString(pubkey[0].PrimaryKey.Fingerprint)
+		}
+
+		if normalizeFingerprint(pin.Fingerprint) == fingerprint {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", ":", "").Replace(fingerprint))
+}
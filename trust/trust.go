@@ -1,11 +1,13 @@
 package trust
 
 import (
+	"bytes"
 	"errors"
+	"time"
 
 	"github.com/envkey/envkey-fetch/crypto"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
 type Signer struct {
@@ -30,145 +32,255 @@ type TrustedKeyable struct {
 }
 
 func (keyable *TrustedKeyable) VerifyInviter(inviterKeyable *TrustedKeyable) error {
+	return keyable.VerifyInviterAt(inviterKeyable, time.Now())
+}
+
+// VerifyInviterAt checks the invite chain as of now: the inviter's key, the
+// invite key and both certifications must be valid at that time.
+func (keyable *TrustedKeyable) VerifyInviterAt(inviterKeyable *TrustedKeyable, now time.Time) error {
+	_, err := keyable.verifyInviter(inviterKeyable, now, &Step{})
+	return err
+}
+
+// verifyInviter also returns the time until which the invitation holds, or a
+// zero time if it doesn't expire.
+func (keyable *TrustedKeyable) verifyInviter(inviterKeyable *TrustedKeyable, now time.Time, step *Step) (time.Time, error) {
 	// Verify signed key signature
 	pubkeyArmored := keyable.PubkeyArmored
 	invitePubkeyArmored := keyable.InvitePubkeyArmored
 	inviterPubkeyArmored := inviterKeyable.PubkeyArmored
 
-	err := crypto.VerifyPubkeyArmoredSignature([]byte(invitePubkeyArmored), []byte(inviterPubkeyArmored))
-	if err != nil {
-		return err
+	inviteValidUntil, err := crypto.VerifyPubkeyArmoredSignatureUntil([]byte(invitePubkeyArmored), []byte(inviterPubkeyArmored), now)
+	if step.check(CheckInviteSignature, err) != nil {
+		return time.Time{}, err
 	}
 
 	// If invite, further verify that pubkey was signed by invite key
-	return crypto.VerifyPubkeyArmoredSignature([]byte(pubkeyArmored), []byte(invitePubkeyArmored))
+	validUntil, err := crypto.VerifyPubkeyArmoredSignatureUntil([]byte(pubkeyArmored), []byte(invitePubkeyArmored), now)
+	if step.check(CheckPubkeySignature, err) != nil {
+		return time.Time{}, err
+	}
+
+	if validUntil.IsZero() || (!inviteValidUntil.IsZero() && inviteValidUntil.Before(validUntil)) {
+		validUntil = inviteValidUntil
+	}
+	return validUntil, nil
 }
 
 type TrustedKeyablesMap map[string]TrustedKeyable
 
 func (trustedKeyables TrustedKeyablesMap) SignerTrustedKeyable(signer *Signer) (*TrustedKeyable, error) {
-	if trusted, ok := trustedKeyables[signer.Id]; ok {
-		trustedPubkey, err := crypto.ReadArmoredKey([]byte(trusted.PubkeyArmored))
-		if err != nil {
-			return nil, err
-		}
+	return trustedKeyables.SignerTrustedKeyableAt(signer, time.Now())
+}
 
-		if trustedPubkey[0].PrimaryKey.Fingerprint == signer.Pubkey[0].PrimaryKey.Fingerprint {
-			return &trusted, nil
-		} else {
-			return nil, errors.New("Signer pubkey fingerprint does not match trusted pubkey fingerprint.")
-		}
-	} else {
+// SignerTrustedKeyableAt also requires the signer's key to be unexpired and
+// unrevoked at now.
+func (trustedKeyables TrustedKeyablesMap) SignerTrustedKeyableAt(signer *Signer, now time.Time) (*TrustedKeyable, error) {
+	return trustedKeyables.signerTrustedKeyable(signer, now, "", &Explanation{})
+}
+
+func (trustedKeyables TrustedKeyablesMap) signerTrustedKeyable(signer *Signer, now time.Time, source string, explanation *Explanation) (*TrustedKeyable, error) {
+	trusted, ok := trustedKeyables[signer.Id]
+	if !ok {
 		return nil, nil
 	}
+
+	step := explanation.step(signer.Id, source, &trusted)
+
+	trustedPubkey, err := crypto.ReadArmoredKey([]byte(trusted.PubkeyArmored))
+	if err == nil && (len(trustedPubkey) == 0 || len(signer.Pubkey) == 0) {
+		err = errors.New("No public key found.")
+	} else if err == nil && !bytes.Equal(trustedPubkey[0].PrimaryKey.Fingerprint, signer.Pubkey[0].PrimaryKey.Fingerprint) {
+		err = errors.New("Signer pubkey fingerprint does not match trusted pubkey fingerprint.")
+	}
+	if step.check(CheckFingerprint, err) != nil {
+		return nil, explanation.fail(signer.Id, err)
+	}
+
+	err = crypto.VerifyKeyValid(signer.Pubkey, now)
+	if step.check(CheckKeyValid, err) != nil {
+		return nil, explanation.fail(signer.Id, err)
+	}
+
+	return &trusted, nil
 }
 
 func (trustedKeyables TrustedKeyablesMap) TrustedRoot(keyable *TrustedKeyable, creatorTrusted TrustedKeyablesMap) ([]*TrustedKeyable, error) {
-	var trustedRoot *TrustedKeyable
-	var newlyVerified []*TrustedKeyable
-	var ok bool
-	currentKeyable := keyable
-	checked := make(map[string]bool)
+	return trustedKeyables.TrustedRootAt(keyable, creatorTrusted, time.Now())
+}
 
-	for trustedRoot == nil {
-		if currentKeyable.InvitedById == "" {
-			return nil, errors.New("No signing id.")
-		}
+// TrustedRootAt walks the keyable's invite chain to a root in creatorTrusted,
+// following at most DefaultMaxDepth invitations.
+func (trustedKeyables TrustedKeyablesMap) TrustedRootAt(keyable *TrustedKeyable, creatorTrusted TrustedKeyablesMap, now time.Time) ([]*TrustedKeyable, error) {
+	explanation := &Explanation{}
+	explanation.step("", "", keyable)
+	_, _, newlyVerified, err := trustedKeyables.trustedRoot(keyable, newChainWalk(creatorTrusted, now, "", explanation, nil, 0))
+	return newlyVerified, err
+}
 
-		if _, ok = checked[currentKeyable.InvitedById]; ok {
-			return nil, errors.New("Already checked signing id: " + currentKeyable.InvitedById)
-		}
+// trustedRoot also returns the id and keyable of the CreatorTrusted root the
+// chain ends at. Each inviter visited is added to the explanation, with the
+// checks of an invitation recorded on the step of the keyable that was invited.
+// Invitations already in the walk's links aren't verified again. Errors are
+// *ChainError.
+func (trustedKeyables TrustedKeyablesMap) trustedRoot(keyable *TrustedKeyable, walk *chainWalk) (string, *TrustedKeyable, []*TrustedKeyable, error) {
+	var newlyVerified []*TrustedKeyable
+	currentKeyable := keyable
+	currentStep := walk.explanation.Path[len(walk.explanation.Path)-1]
 
-		var inviterKeyable TrustedKeyable
-		inviterKeyable, ok = creatorTrusted[currentKeyable.InvitedById]
-		if ok {
-			trustedRoot = &inviterKeyable
-		} else {
-			inviterKeyable, ok = trustedKeyables[currentKeyable.InvitedById]
-			if !ok {
-				return nil, errors.New("No trusted root.")
-			}
+	for {
+		inviterId, inviterKeyable, inviterStep, err := walk.inviter(currentStep.Id, currentKeyable, trustedKeyables)
+		if err != nil {
+			return "", nil, nil, err
 		}
 
-		err := currentKeyable.VerifyInviter(&inviterKeyable)
+		err = walk.verify(currentKeyable, inviterKeyable, currentStep, inviterStep)
 		if err != nil {
-			return nil, err
+			return "", nil, nil, err
 		}
 
 		// currentKeyable now verified
-		checked[currentKeyable.InvitedById] = true
 		newlyVerified = append(newlyVerified, currentKeyable)
 
-		if trustedRoot == nil {
-			currentKeyable = &inviterKeyable
+		if inviterStep.Root {
+			return inviterId, inviterKeyable, newlyVerified, nil
 		}
+		currentKeyable, currentStep = inviterKeyable, inviterStep
 	}
-
-	if trustedRoot == nil {
-		return nil, errors.New("No trusted root.")
-	}
-
-	return newlyVerified, nil
 }
 
 type TrustedKeyablesChain struct {
 	CreatorTrusted                    TrustedKeyablesMap
 	SignerTrusted                     TrustedKeyablesMap
 	InheritanceOverridesSignerTrusted TrustedKeyablesMap
+
+	// CurrentTime is the time keys and signatures are evaluated at. If zero,
+	// the current time is used.
+	CurrentTime time.Time
+
+	// PinnedRoots, if set, additionally requires the root the verified chain
+	// ends at to be one of these locally pinned keys.
+	PinnedRoots Pins
+
+	// VerifiedLinks, if set, memoizes verified invitations across calls.
+	VerifiedLinks *VerifiedLinks
+
+	// MaxDepth is the maximum number of invitations followed from a signer to
+	// a pinned root. If zero, DefaultMaxDepth is used.
+	MaxDepth int
+}
+
+func (trustedKeyables *TrustedKeyablesChain) now() time.Time {
+	if trustedKeyables.CurrentTime.IsZero() {
+		return time.Now()
+	}
+	return trustedKeyables.CurrentTime
 }
 
 func (trustedKeyables *TrustedKeyablesChain) VerifySignerTrusted(signer *Signer) error {
-	_, _, err := trustedKeyables.SignerTrustedKeyable(signer)
+	_, _, _, err := trustedKeyables.SignerTrustedKeyable(signer)
 	return err
 }
 
-func (trustedKeyables *TrustedKeyablesChain) SignerTrustedKeyable(signer *Signer) (*TrustedKeyable, []*TrustedKeyable, error) {
+// SignerTrustedKeyable returns the signer's trusted keyable and the keyables
+// newly verified on the way to its trusted root, along with an explanation of
+// the path walked. The explanation is returned whether or not verification
+// succeeds.
+func (trustedKeyables *TrustedKeyablesChain) SignerTrustedKeyable(signer *Signer) (*TrustedKeyable, []*TrustedKeyable, *Explanation, error) {
+	explanation := &Explanation{SignerId: signer.Id, IsInheritanceSigner: signer.IsInheritanceSigner}
+
+	trusted, newlyVerified, err := trustedKeyables.signerTrustedKeyable(signer, explanation)
+	if err != nil {
+		if explanation.Error == "" {
+			explanation.fail(signer.Id, err)
+		}
+		return nil, nil, explanation, err
+	}
+
+	explanation.Trusted = true
+	return trusted, newlyVerified, explanation, nil
+}
+
+func (trustedKeyables *TrustedKeyablesChain) signerTrustedKeyable(signer *Signer, explanation *Explanation) (*TrustedKeyable, []*TrustedKeyable, error) {
 	var err error
 	var trusted *TrustedKeyable
 	var newlyVerified []*TrustedKeyable
+	var rootId string
+	var root *TrustedKeyable
+	now := trustedKeyables.now()
 
 	// First check if key is present in CreatorTrusted keys, which means it's trusted, so we can return
-	trusted, err = trustedKeyables.CreatorTrusted.SignerTrustedKeyable(signer)
+	trusted, err = trustedKeyables.CreatorTrusted.signerTrustedKeyable(signer, now, SourceCreator, explanation)
 	if err != nil {
 		return nil, nil, err
 	} else if trusted != nil {
+		explanation.Path[len(explanation.Path)-1].Root = true
+		walk := newChainWalk(trustedKeyables.CreatorTrusted, now, SourceCreator, explanation, trustedKeyables.VerifiedLinks, trustedKeyables.MaxDepth)
+		err = trustedKeyables.verifyPinnedRoot(signer.Id, trusted, walk)
+		if err != nil {
+			return nil, nil, err
+		}
 		return trusted, []*TrustedKeyable{}, nil
 	}
 
+	var signerTrusted TrustedKeyablesMap
+	var source string
+
 	if signer.IsInheritanceSigner {
-		if trustedKeyables.InheritanceOverridesSignerTrusted == nil {
-			return nil, nil, errors.New("Inheritance overrides signer not trusted.")
-		}
+		signerTrusted, source = trustedKeyables.InheritanceOverridesSignerTrusted, SourceInheritance
+	} else {
+		signerTrusted, source = trustedKeyables.SignerTrusted, SourceSigner
+	}
 
-		// If inheritance overrides signer, find key in InheritanceOverridesSignerTrusted
-		trusted, err = trustedKeyables.InheritanceOverridesSignerTrusted.SignerTrustedKeyable(signer)
-		if err != nil {
-			return nil, nil, err
-		} else if trusted == nil {
-			return nil, nil, errors.New("Inheritance overrides signer not trusted.")
-		}
+	notTrustedErr := errors.New("Signer not trusted.")
+	if signer.IsInheritanceSigner {
+		notTrustedErr = errors.New("Inheritance overrides signer not trusted.")
+	}
 
-		// Then attempt to validate trust chain back to a CreatorTrusted key
-		newlyVerified, err = trustedKeyables.InheritanceOverridesSignerTrusted.TrustedRoot(trusted, trustedKeyables.CreatorTrusted)
+	// Find the signer's key in the map for its role (SignerTrusted for the env
+	// signer, InheritanceOverridesSignerTrusted for the inheritance overrides
+	// signer)
+	if signerTrusted != nil {
+		trusted, err = signerTrusted.signerTrustedKeyable(signer, now, source, explanation)
 		if err != nil {
 			return nil, nil, err
 		}
+	}
+	if trusted == nil {
+		explanation.step(signer.Id, "", nil)
+		return nil, nil, explanation.fail(signer.Id, notTrustedErr)
+	}
 
-	} else {
-		// If env signer, find key in InheritanceOverridesSignerTrusted (checking only InheritanceOverridesSignerTrusted keys)
-		trusted, err = trustedKeyables.SignerTrusted.SignerTrustedKeyable(signer)
-		if err != nil {
-			return nil, nil, err
-		} else if trusted == nil {
-			return nil, nil, errors.New("Signer not trusted.")
-		}
+	// Then attempt to validate trust chain back to a CreatorTrusted key (checking only keys from the same map)
+	walk := newChainWalk(trustedKeyables.CreatorTrusted, now, source, explanation, trustedKeyables.VerifiedLinks, trustedKeyables.MaxDepth)
+	rootId, root, newlyVerified, err = signerTrusted.trustedRoot(trusted, walk)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Then attempt to validate trust chain back to a CreatorTrusted key (checking only SignerTrusted keys)
-		newlyVerified, err = trustedKeyables.SignerTrusted.TrustedRoot(trusted, trustedKeyables.CreatorTrusted)
-		if err != nil {
-			return nil, nil, err
-		}
+	err = trustedKeyables.verifyPinnedRoot(rootId, root, walk)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return trusted, newlyVerified, nil
 }
+
+// verifyPinnedRoot checks that the root a chain ended at is itself pinned. A
+// root's own inviter being pinned isn't enough, since a compromised admin
+// invited by a pinned owner could then vouch for a rogue signer.
+func (trustedKeyables *TrustedKeyablesChain) verifyPinnedRoot(rootId string, root *TrustedKeyable, walk *chainWalk) error {
+	if len(trustedKeyables.PinnedRoots) == 0 {
+		return nil
+	}
+
+	step := walk.explanation.Path[len(walk.explanation.Path)-1]
+	pinned, err := trustedKeyables.PinnedRoots.Matches(rootId, root)
+	if err != nil {
+		return walk.explanation.fail(rootId, step.check(CheckPinned, err))
+	} else if !pinned {
+		return walk.explanation.fail(rootId, step.check(CheckPinned, ErrRootNotPinned))
+	}
+	step.check(CheckPinned, nil)
+	return nil
+}
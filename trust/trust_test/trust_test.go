@@ -1,16 +1,29 @@
 package trust_test
 
 import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/envkey/envkey-fetch/crypto"
 
 	"github.com/envkey/envkey-fetch/trust"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
 )
 
-var owner = trust.TrustedKeyable{ownerPubkey, "", ""}
-var admin = trust.TrustedKeyable{adminPubkey, adminInvitePubkey, "owner-id"}
-var dev = trust.TrustedKeyable{devPubkey, devInvitePubkey, "admin-id"}
-var invalidAdmin = trust.TrustedKeyable{invalidPubkey, invalidInvitePubkey, "admin-id"}
+var owner = trust.TrustedKeyable{PubkeyArmored: ownerPubkey}
+var admin = trust.TrustedKeyable{PubkeyArmored: adminPubkey, InvitePubkeyArmored: adminInvitePubkey, InvitedById: "owner-id"}
+var dev = trust.TrustedKeyable{PubkeyArmored: devPubkey, InvitePubkeyArmored: devInvitePubkey, InvitedById: "admin-id"}
+var invalidAdmin = trust.TrustedKeyable{PubkeyArmored: invalidPubkey, InvitePubkeyArmored: invalidInvitePubkey, InvitedById: "admin-id"}
 var trustedKeyables = trust.TrustedKeyablesChain{
 	CreatorTrusted:                    trust.TrustedKeyablesMap{"owner-id": owner},
 	SignerTrusted:                     trust.TrustedKeyablesMap{"admin-id": admin, "invalid-admin-id": invalidAdmin},
@@ -26,11 +39,22 @@ func TestVerifyInviter(t *testing.T) {
 	err = admin.VerifyInviter(&owner)
 	assert.Nil(t, err, "Should not return an error.")
 
-	invalidInviter := trust.TrustedKeyable{devPubkey, "", ""}
+	invalidInviter := trust.TrustedKeyable{PubkeyArmored: devPubkey}
 	err = admin.VerifyInviter(&invalidInviter)
 	assert.NotNil(t, err, "Should return an error.")
 }
 
+func TestVerifyInviterAt(t *testing.T) {
+	var err error
+
+	err = admin.VerifyInviterAt(&owner, time.Now())
+	assert.Nil(t, err, "Should not return an error.")
+
+	// The fixture keys were generated in 2017
+	err = admin.VerifyInviterAt(&owner, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.NotNil(t, err, "Should reject keys and signatures from the future.")
+}
+
 func TestKeyablesMapSignerTrustedKeyable(t *testing.T) {
 	var trusted *trust.TrustedKeyable
 	var err error
@@ -52,27 +76,152 @@ func TestTrustedKeyablesChainSignerTrustedKeyable(t *testing.T) {
 	var err error
 
 	// Shallow trust chain
-	keyable, newlyVerified, err = trustedKeyables.SignerTrustedKeyable(adminSigner)
+	keyable, newlyVerified, _, err = trustedKeyables.SignerTrustedKeyable(adminSigner)
 	assert.Nil(t, err, "Should not return an error.")
 	assert.Equal(t, keyable, &admin, "Should return the trusted keyable.")
 	assert.Equal(t, newlyVerified, []*trust.TrustedKeyable{&admin}, "Should return newly verified keyables.")
 
 	// Deep trust chain
-	keyable, newlyVerified, err = trustedKeyables.SignerTrustedKeyable(devInheritanceSigner)
+	keyable, newlyVerified, _, err = trustedKeyables.SignerTrustedKeyable(devInheritanceSigner)
 	assert.Nil(t, err, "Should not return an error.")
 	assert.Equal(t, keyable, &dev, "Should return the trusted keyable.")
 	assert.Equal(t, newlyVerified, []*trust.TrustedKeyable{&dev, &admin}, "Should return newly verified keyables.")
 
 	// Invalid shallow
 	missingSigner, _ := trust.NewSigner("missing-id", devPubkey, true)
-	_, _, err = trustedKeyables.SignerTrustedKeyable(missingSigner)
+	_, _, _, err = trustedKeyables.SignerTrustedKeyable(missingSigner)
 	assert.NotNil(t, err, "Should return an error.")
 
 	// Invalid deep
-	_, _, err = trustedKeyables.SignerTrustedKeyable(invalidSigner)
+	_, _, _, err = trustedKeyables.SignerTrustedKeyable(invalidSigner)
+	assert.NotNil(t, err, "Should return an error.")
+
+	// Evaluated before the keys existed
+	pastChain := trustedKeyables
+	pastChain.CurrentTime = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, _, _, err = pastChain.SignerTrustedKeyable(adminSigner)
 	assert.NotNil(t, err, "Should return an error.")
 }
 
+func TestSignerTrustedKeyableExplanation(t *testing.T) {
+	var explanation *trust.Explanation
+	var err error
+
+	// Deep trust chain: dev -> admin -> owner
+	_, _, explanation, err = trustedKeyables.SignerTrustedKeyable(devInheritanceSigner)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.True(t, explanation.Trusted, "Should be trusted.")
+	assert.True(t, explanation.IsInheritanceSigner, "Should record the signer role.")
+	assert.Equal(t, "", explanation.BrokenAt, "Should not break.")
+	if assert.Len(t, explanation.Path, 3, "Should walk to the root.") {
+		dev, admin, owner := explanation.Path[0], explanation.Path[1], explanation.Path[2]
+		assert.Equal(t, []string{"dev-id", "admin-id", "owner-id"}, []string{dev.Id, admin.Id, owner.Id})
+		assert.Equal(t, []string{trust.SourceInheritance, trust.SourceInheritance, trust.SourceCreator}, []string{dev.Source, admin.Source, owner.Source})
+		assert.Equal(t, fingerprint(devPubkey), dev.Fingerprint, "Should record the fingerprint.")
+		assert.Equal(t, "admin-id", dev.InvitedById, "Should record the inviter.")
+		assert.True(t, owner.Root, "Should mark the root.")
+		assert.Equal(t, []trust.Check{
+			{Name: trust.CheckFingerprint, Passed: true},
+			{Name: trust.CheckKeyValid, Passed: true},
+			{Name: trust.CheckInviteSignature, Passed: true},
+			{Name: trust.CheckPubkeySignature, Passed: true},
+		}, dev.Checks, "Should record the checks made.")
+		assert.Len(t, admin.Checks, 2, "Should record the invite checks.")
+		assert.Empty(t, owner.Checks, "Should not check the root.")
+	}
+
+	// Broken deep chain
+	_, _, explanation, err = trustedKeyables.SignerTrustedKeyable(invalidSigner)
+	assert.NotNil(t, err, "Should return an error.")
+	assert.False(t, explanation.Trusted, "Should not be trusted.")
+	assert.Equal(t, "invalid-admin-id", explanation.BrokenAt, "Should record where the chain broke.")
+	assert.Equal(t, err.Error(), explanation.Error, "Should record the error.")
+	if assert.Len(t, explanation.Path, 2, "Should stop at the break.") {
+		checks := explanation.Path[0].Checks
+		assert.False(t, checks[len(checks)-1].Passed, "Should record the failed check.")
+	}
+
+	// Signer missing from every map
+	missingSigner, _ := trust.NewSigner("missing-id", devPubkey, false)
+	_, _, explanation, err = trustedKeyables.SignerTrustedKeyable(missingSigner)
+	assert.NotNil(t, err, "Should return an error.")
+	assert.Equal(t, "missing-id", explanation.BrokenAt, "Should record where the chain broke.")
+	if assert.Len(t, explanation.Path, 1) {
+		assert.Equal(t, "", explanation.Path[0].Source, "Should not find a source.")
+	}
+
+	// Pinning
+	pinned := trustedKeyables
+	pinned.PinnedRoots = trust.Pins{{Id: "owner-id", Fingerprint: fingerprint(adminPubkey)}}
+	_, _, explanation, err = pinned.SignerTrustedKeyable(adminSigner)
+	assert.Equal(t, trust.ErrRootNotPinned, err)
+	assert.Equal(t, "owner-id", explanation.BrokenAt, "Should break at the unpinned root.")
+	assert.Equal(t, trust.Check{Name: trust.CheckPinned, Error: err.Error()}, explanation.Path[1].Checks[0])
+}
+
+func fingerprint(pubkeyArmored string) string {
+	pubkey, _ := crypto.ReadArmoredKey([]byte(pubkeyArmored))
+	return hex.EncodeToString(pubkey[0].PrimaryKey.Fingerprint)
+}
+
+func TestPinnedRoots(t *testing.T) {
+	var err error
+
+	ownerPin := trust.Pin{Id: "owner-id", Fingerprint: fingerprint(ownerPubkey)}
+
+	pinned := trustedKeyables
+	pinned.PinnedRoots = trust.Pins{ownerPin}
+	_, _, _, err = pinned.SignerTrustedKeyable(adminSigner)
+	assert.Nil(t, err, "Should not return an error.")
+	_, _, _, err = pinned.SignerTrustedKeyable(devInheritanceSigner)
+	assert.Nil(t, err, "Should not return an error.")
+
+	pinned.PinnedRoots = trust.Pins{{Id: "owner-id", Fingerprint: fingerprint(adminPubkey)}}
+	_, _, _, err = pinned.SignerTrustedKeyable(adminSigner)
+	assert.Equal(t, trust.ErrRootNotPinned, err, "Should require the fingerprint to match.")
+
+	pinned.PinnedRoots = trust.Pins{{Id: "admin-id", Fingerprint: fingerprint(adminPubkey)}}
+	_, _, _, err = pinned.SignerTrustedKeyable(adminSigner)
+	assert.Equal(t, trust.ErrRootNotPinned, err, "Should not accept a pinned signer that isn't a root.")
+
+	// When admin is also creator trusted, the chain ends at admin, which
+	// isn't pinned even though the owner who invited it is
+	pinned.CreatorTrusted = trust.TrustedKeyablesMap{"owner-id": owner, "admin-id": admin}
+	pinned.PinnedRoots = trust.Pins{ownerPin}
+	_, _, explanation, err := pinned.SignerTrustedKeyable(adminSigner)
+	assert.Equal(t, trust.ErrRootNotPinned, err, "Should not follow an unpinned root to a pinned inviter.")
+	assert.Equal(t, "admin-id", explanation.BrokenAt, "Should break at the unpinned root.")
+	_, _, _, err = pinned.SignerTrustedKeyable(devInheritanceSigner)
+	assert.Equal(t, trust.ErrRootNotPinned, err, "Should not trust a signer invited by an unpinned root.")
+
+	pinned.CreatorTrusted = trust.TrustedKeyablesMap{"admin-id": admin}
+	_, _, _, err = pinned.SignerTrustedKeyable(adminSigner)
+	assert.Equal(t, trust.ErrRootNotPinned, err, "Should not find a pinned root.")
+}
+
+func TestPinFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "envkey-fetch-pins")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pins.json")
+	ioutil.WriteFile(path, []byte(`{"envkey-id": [{"id": "owner-id", "fingerprint": "AB:CD"}]}`), 0600)
+
+	pinFile, err := trust.ReadPinFile(path)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, trust.Pins{{Id: "owner-id", Fingerprint: "AB:CD"}}, pinFile["envkey-id"])
+
+	ioutil.WriteFile(path, []byte(`{"envkey-id": [{"id": "owner-id", "fingerprint": "not hex"}]}`), 0600)
+	_, err = trust.ReadPinFile(path)
+	assert.NotNil(t, err, "Should reject invalid fingerprints.")
+
+	pin, err := trust.ParsePin("owner-id=abcd")
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, trust.Pin{Id: "owner-id", Fingerprint: "abcd"}, pin)
+
+	_, err = trust.ParsePin("owner-id")
+	assert.NotNil(t, err, "Should require a fingerprint.")
+}
+
 var ownerPubkey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\r\nVersion: OpenPGP.js v2.5.4\r\nComment: http://openpgpjs.org\r\n\r\nxsBNBFmCzjMBCAC6y3B/mkv5d5K77MMKxOqbAq88cdCCQk6BQ8KlW1WD07af\n9f2LUnyzPfsguCZTIGaT527eYJYZhbELvAmo3w3L2yMZq/LniBQv41QE2H05\nm2khLeREGcX6dEoPauJz6Fqfg/4VAdovFEbmYCzIfahd/8sxMtaSIX4KMfoN\nyLP8MDM6ujFPGKNLGvArXqsUYb1Hi4nJZOI5vBvLIzMX3jUAJxU+UxO+oKiU\nc994OboSvU6ANdjuGmK5y8MvaHco+SZ+NiijEq8EJDr6hRmivJ+5fvISjKP7\nDpaotN7BWTS02BqmNauSFFFbh0aMSAdU3uIhTP1/9uib1KgKS7j3QGhtABEB\nAAHNjjk5MmY1MThkODlmMDNiNWI1MTYwYjNmNGU4ZjA2ZDEyNDBlYWQ3ZDE5\nNDliNDVmYmMwMjJjNTNhNGE2MDk3ZmYgPDk5MmY1MThkODlmMDNiNWI1MTYw\nYjNmNGU4ZjA2ZDEyNDBlYWQ3ZDE5NDliNDVmYmMwMjJjNTNhNGE2MDk3ZmZA\nZW52a2V5LmNvbT7CwHUEEAEIACkFAlmCzjQGCwkHCAMCCRB+EhPA1+WGuwQV\nCAoCAxYCAQIZAQIbAwIeAQAAw6QH/iUlSG5zmUyUihvh4IVdAqjtGPcLOxxO\nVzhLYQRTuHbgj/8JZ2/XRvFXAf+XH30a/PElDOofaBPEkU5JBKt1t4/D2cn1\no40pSpOpqnatTZba93/awvfU7lKY+KU4XWh47ynefdLjpBkdfLbAhBel8RAF\n9Jcwf2/rSCP9WghFxYnBxcTWTq8X7ic5A90yln0VagbgbLZEFzWkgpLauBaq\n9bYU5KPwSamdQmW0U2KlZQdJB5j3/NGT5SNn/YY3eYjTJtKwgEjyeUGsFhqq\nRrmdgF9k+lOJ32fBwrPMUgaDZfk2c89IoEcW3n8u9Vh2apPUhGbBnj4+KFzD\nYTHJnRBmyRrOwE0EWYLOMwEIANSYbzN7fyExhv2fjrXrY/5UuWFUPpnLB6sJ\npr5Y5v6LrJWAo9mcuFqpfciZTqbhbM2SCE7x+npbMg2qS5ZZRt/7ZQGodaaw\n/CWl51wbAhF3g2qKg/N+OxLfzePxG+gz7U4kUdxdQfvkcXK5RCoOEn0wMRGI\n/JyHQNJT12GCF/XYY8Tj9jWR3nMN23FN0A5T4wYEWei3ReXb9hUFKopc97la\ngkGjSyXbYZOH5XncBQ4dq4KuU661O5QyGGA0Kc8wjC7PTB+5vVonEio15eoM\nB8H94zwf5PAo8tEClKOw/WBtDk8rs60V/i1kDELIMlHjxp5qYFOlxAO4/VVw\nPb5vOfsAEQEAAcLAXwQYAQgAEwUCWYLONQkQfhITwNflhrsCGwwAAPNZB/0Z\noMNT2B1uzAK82EpD6BZjyjeejDEQZu0sDwwihBe0b9KhaJJNOiSVK+CMC6JF\n0OexaQBRdFS0FReofVbM35oOLc+X7XVAzmt9+3AcgsxLcqduVYSz9HfI7MdD\n5FS+QiGhExlLVNY/CAVtE+2/oNunDQszdHK31I7FQU+8QKnMt2UEOtrdfXby\ncBfKb7P/8EU4IlJP98qepXn4m29PgrxXiTwXl5lJYcZ0ilVmJuf9JfcMMggJ\nbS1PtNOd1h1JA8THRcsbMnRJOfOfcujwthGlUrPQGKfOZnnT70hY+/ohGJLT\nD0C+/TSjGDWsEHrK16YpQ5xfOoPZvh3HsYzpAqjR\r\n=XXQ6\r\n-----END PGP PUBLIC KEY BLOCK-----\r\n\r\n"
 
 var adminInvitePubkey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\r\nVersion: OpenPGP.js v2.5.4\r\nComment: http://openpgpjs.org\r\n\r\nxsBNBFmC0DABCADPY1LFsN5ismxcMoakQHsI99vqVPuL4gl8XQjwKuhauDyv\ncfv/TidY4ByvT345kGuKEr1aO7hhQq7zMR4UEr7LFDvxKS/tUP3iDKctojV+\nVEP6pJXNEz6sjRDsBORBgcbQtO6+WVA5WJdajnRO9gvJekYW2oDenZec/Qti\nsYbY42L3X6sHISFeVaE2XxMgOw7kjMDeeTnkjIoMK7jwl6JWJluLzijaZcj1\niB65npGPqPcF1T/lrLlvoZhynaz15GURgs2FfPG30Fh1pnJR/WQyLrQhRCMi\nt6oHsBKS+ALkCqXex5hybwI3hFkVSF/PJNWp7ZbI7/uRiyiekOPP8HuZABEB\nAAHNjmNjZDU3NjUyNTM5MWM3ZjZkMWNjNzlhOTYxZjc3NWU3NmJjNWM2NTNi\nNTk0NDIzNzdiMmNhYWZiZDEyNzg0OGEgPGNjZDU3NjUyNTM5MWM3ZjZkMWNj\nNzlhOTYxZjc3NWU3NmJjNWM2NTNiNTk0NDIzNzdiMmNhYWZiZDEyNzg0OGFA\nZW52a2V5LmNvbT7CwHUEEAEIACkFAlmC0DEGCwkHCAMCCRBxjuox5N0ODwQV\nCAoCAxYCAQIZAQIbAwIeAQAATCcH/jcDS+WYGa21UP01D13FR2ZDW63cxT3F\nH7EIjHQvig3VcVBIFQF/kGkJ4B36dfgOCFxplumy56hkUQ7OQ6Ev5wQwsF0J\nI4UydleTr/KqK9rY2UPh4V29HxrmBe0iVu2CPLYHzLqfHGDLK5LNlRgpPgQZ\nkdNJJOPQIUn4HQ10O8fZf9MoNjv8NSs+kFtQXQp/cwuh+hPXaqG9j5f/EYwp\ngMem0KDdMcHZ8/x2++LCgjsy07fGczXX6W94Uy8Yr9tRBqXC3oj/Q0eNA+lf\nwvW8ZSf2r+2dATYgelyCoY18yYwITTn2sbxNkVsNT2df1KnA6WcIWTVErlJ8\nyiq0+p1foBrCwF8EEAEIABMFAlmC0DIJEH4SE8DX5Ya7AhsDAADvGwf6AuhP\ntGq2sUbIZx4GdpZ6qu8OgcmSLhpgaDpuCiassm9zCjm/FkxwliywMlGCCMGR\naQVnVJPgGSFvrLpAoCL6qSOb5JbxXi4JQYZM2qlBzwcwpnF1R1Pcm5VNL1gu\n6kLy5+Xc0iM+JMsSlDU8SFunypASVzlgviPYLzpGLsXJREFGq4MCTnzk1iaQ\ncOMsHSQP72/re8K1XX3Prhz1uxBLrbmNB98jlZzW5D43b+J87gmsI8TXF65r\nRxtssyp81G26z1px/yCtyQN6Qe/kxlbO6drnRlk+u20LkhI1m0P15Z8CrwLM\nVNEcSRGxEsZVxJWfY13OjNiWuDNIKjqOI3us6M7ATQRZgtAwAQgArPUe9IPT\ncpMBb+k0SavL9h0Gux3waAwjgvMWjO0mJ/BT6z6At51OVQVf492MLuZ+UmDA\nLZSDksRryvRETn/dQ7apOtwpsYfb0XZQjhX5svP0VhtqrWqoTMkClhVeQ4Oe\nhEM/g1ph6OB4OqAOXZ7RBoAv37X4ekUF/Onp61wZqudxRlVb0v/gZDtl1KHt\nuDuhipvMfUNaV4CIOzbmPIdrjTYneY9KEp/zHPAj9DEjOOu6MjImuhdFTEXE\nCn2uXY5tLLBhcMb/CcURfF8qI4i5oebfTBSVYjipQtVONCNsWvG54PVpzv3S\nLngmoHQ9807lnLmFeC8Eah4zovFDGOteyQARAQABwsBfBBgBCAATBQJZgtAx\nCRBxjuox5N0ODwIbDAAA0JoH/2hCMx4Biod77+UMUBIA526XLTwrVYSfO2kU\n89a5ClJh3ynKdZShA1cD9IZm+tcegBITs2puOw2MPwWw16AZCu1OP3y4lScI\nhWiMF1WfQ24PB+nhto5Z/ITTxX1OtJcglow1lnFa6uWu53XCbwuGAR7+FhdC\nA9vYBLgAotI6/feOK8btx5MjaYxogh5x0Mk/CwhVbIZ7ao0lFneqdfmoa11F\nRhGKsEVl5hcckgqM/6nIcNO5r/W3HZt+T3jUVTIlNA6+DikGQiHCHfXmlAd8\nPxS8HlLF6UkWpRcT8DBvMtDEbKjwnxD+UxwIDxW0/rzeaVlx50jL6ePrXJ8v\nsajdogs=\r\n=GNbh\r\n-----END PGP PUBLIC KEY BLOCK-----\r\n\r\n"
@@ -86,3 +235,266 @@ var devPubkey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\r\nVersion: OpenPGP.js v2.
 var invalidPubkey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\r\nVersion: OpenPGP.js v2.5.4\r\nComment: http://openpgpjs.org\r\n\r\nxsBNBFmBC4IBCACl7nerYYcOByK8ytPwN1MUohF94c9Xkl9sF4upzKmioiA8\niNwYwcE7fzd3r5lsJg/Kfijf7kfa083okzHufHSwPWt6WSe7svPmVpq0g+qr\na8vHNFteDv9h1V1EAzCe9iB0BpsVwJ4eHv27cCzpkdu4G5jpoG+7LVS9DSe7\n332JwuzMGQBZ8yg7UxkhTHbIfVFBEh+Ae1OINiVaMGC52BBAS+1bIC0VRx+w\n9F+QX5mRaF4QVzffrGOlU6T04QmLCTTJvRA6kM1zxPNYNZB0XKRD/MiRg31A\nD5jqY3adLW6xPoe5Q6YSXpJfXTh8Nahsy3lzkc2gssUuGgOACr5HIupzABEB\nAAHNjjVhNWI0ZTdjYmJjMzJjZjdiZmM0NmQyZDFiYjZlY2ZkOTI1Y2E5NWE2\nZDdiNGQ3NDg0MDBkMWZhZGQ1M2ZkMTMgPDVhNWI0ZTdjYmJjMzJjZjdiZmM0\nNmQyZDFiYjZlY2ZkOTI1Y2E5NWE2ZDdiNGQ3NDg0MDBkMWZhZGQ1M2ZkMTNA\nZW52a2V5LmNvbT7CwHUEEAEIACkFAlmBC4MGCwkHCAMCCRBN+98ZEYM2tAQV\nCAoCAxYCAQIZAQIbAwIeAQAAXWgIAIfU71QBr1YPC3EYQJrK6Ulq4tm5F2lC\nz47fpcWW9gFgHP5bEcHZtqHRChiYb/zznAAj4aYT6tx/zxEjYskgp67oS6lB\nRSEgfzVU230y1fFGRjEkgEP4aC8vtgCQaR11xQJ5cFeucQ9B4h/GWFnl4A3p\nfi2Sn5jWdtfjzQOR5FdbOBlnjA7AIeh1Mnr5Grlj4blVZsHkdRWGgrmRvmFY\nz4va5ACyg0F02AA8ilTrSOoiA/Q7bBmcuNoFpoTWIkjVoh0u9mQddyjsqZcz\n5TyUHff5iyh0jA+cdQNZZbqUy6GY76tY0ftBqgdMnYhl5q1D1yLHePIkZQcT\ncCVc9rVWFH/OwE0EWYELggEIAMD/AsPtS/NkPH8g6Iq2YZGleXkCPDzm72O7\nfK41v3qWxHWEaJHqPUWSVusRr15kBef5CHyR5vbQ/DlrurC2XkDxZXTJwCwd\nAJS4plrKgqSxvAg1uBFA8WJ6ol64A8e6tfidJ3BKXJpuTFEvJfMgZJhGXApf\npvwjr14q1JgssiVZB05N76E5EQ6A0qYequYLOElv1+OqLF72+5JtvfmxOE7D\nFlSyXFtha0L/mHx+YF+pjdKxAMSGCU8Mgtdy8VhhrE8jpdAMwVvrEaM9/sDp\nnT8DNq7k7MyLAx9o5Scud6nnj/ApfEZQ+qplUDpCc+q/jFUFr/9Mcwpw3j1G\neTYSl+EAEQEAAcLAXwQYAQgAEwUCWYELgwkQTfvfGRGDNrQCGwwAAIj4B/4i\nLzAVDDpEgzMjJWOtJt56aVcCddrrNBpokXkNt6Csi0xMSULDFJ+GwuWe4FC6\nz2OqfdCZSKSK0urn2CjVtjmKMOti6n2zHsyIjPa6fANiN5AT2jN24/tFBYGq\n0TepPaq9TqJ4p6Pl4X+QZx0XU4dTuCzjVmPBgt5CEm6Xe/ZL8OUCOm7LXN5V\nV6ZvGA4czqYv88I+a/d7a0kSwxAfXFHdDywSoUiTds4guNtLoYvX8ey8DRtZ\nMC8WtqlfTWFL+UNKelTs2/AuN2Ee9obNylF46gXu3oWFzfEYyeGs9I0i6ZEa\n7lNJAh0DYRAjzphImhDUFXocx/d3velZ/oCvGAhM\r\n=w9ow\r\n-----END PGP PUBLIC KEY BLOCK-----\r\n\r\n"
 
 var invalidInvitePubkey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\r\nVersion: OpenPGP.js v2.5.4\r\nComment: http://openpgpjs.org\r\n\r\nxsBNBFmBEtUBCACgY9ybvYbW6fNhGCmUmoWaDZTn7CFYC8YRuKBfvmPTms1/\nP80VtY+hl9DYDMJu7V7iP8AwDWVNioqS3fW34RfFkF5/bVZfUEYUOoor0JHc\nHkIJgkayFNSpgiDucWIZ8TLcI/smUjpcT3epvR+tmBil7E0bY80EDEsYz3cd\nIdZGVV2yihwTSRqhPFVYD0iCWwqOAwuecFnpi6roUDXPHUUAuSbazwFsLTyg\nppunqya7le6DaeHX1bG8YPWNk21uK9oehZQbKAE1I7oBOG20vyFCZvStZAIe\nasGGnhE58u94fIv9aopiAz0ngCOyZ41YTp9KY+ZDOdvGkXPIvybIrqCXABEB\nAAHNjjAwNDljMDM3MzViNTEyMzRkNzg5YTA5ZDI1MGFiZWJjODVmMTk5YTNi\nOTBiNDc1NjZlZjY4YjI4ZDk0NDVhYzEgPDAwNDljMDM3MzViNTEyMzRkNzg5\nYTA5ZDI1MGFiZWJjODVmMTk5YTNiOTBiNDc1NjZlZjY4YjI4ZDk0NDVhYzFA\nZW52a2V5LmNvbT7CwHUEEAEIACkFAlmBEtYGCwkHCAMCCRAK77Qge/sL8gQV\nCAoCAxYCAQIZAQIbAwIeAQAA+UUIAIiPMR6ePRiytkJZ1arnmFHuunBgVr+I\n+g02OS6NK8VH2p3ekzud3rrTuMDqvwr9UjD7bb2tnnr9QKoATdsCcQNag3hE\ndCyreYH4r0xYSq5GorhgnGUosaStscHxBOZD76v9Ah5WHpqNh28vdvVUEAdD\nTYHqyALPYYgDJuvv5qrgreEnJavHZohwGOX9PQwdRR5bLbxLciXyf/F4O6Bb\nCEJaWqd4+WrLMKry8C4JafdLYUFlwkfP15SCemuJYCFORbb9qoXNBxWpH50S\nWaB0P4XDdHk36JHmeuOt/FSont7yL5GvXZjJBl5HNWh1TPV2mn5AlKJvh4B1\nTixr7OdDlbHCwF8EEAEIABMFAlmBEtcJEE373xkRgza0AhsDAAAWmggAlDN9\nOXvTz5bcAYoblPLJ97vP9Y4/ieGXH1AYfWQZO9GDIit/n1IgCJEsYxswnO5a\nb2MWEP2pzlQyNHlShN0x/JT7kND4ftLGImxfegmYgRBs50g2DKAu6/vs3Uzv\nqLQ2YoiXylI79pf20Dm/gemoPWTwDPlEgnBzniLfJXat6dM/Hp7VsnsZnWc5\nw3VEmvDPqiwFDDQyCqKYukPGA1lItRaWnwigLHdf6P3IwXKdPYGG1spvG2im\n6BueKkPuys73ItJ2eaJlyTw2YFK1CE6QnJnDv5ZFjAF/PSMFg1XyvAz1tHFz\nvlBdc51H4CUtcXucZvjR1QgbXvP6vT9Xy4iDas7ATQRZgRLVAQgAx5/blkUU\n5bNlFWJ/VtfZioAqpQv+U9RJI0gcChlom5KNVC/XNOApfJilR9PUxs2NZHXm\naQ8QnP2hYYAmAkC8Vq+FLZuPEzYnQPTDIRRoiyIHwRFlIAef8D+ynwyg1CGD\numG3g1WismK5cMoHdbFkvZxhTRYUrJ6s1lXe7Ycb9emD7l++HS5CaIzqnp2H\nfsdlcygJc0lFhJrr1fogpAxaUMFM3uuB5Pg03/az3BqEh7Nhsd9/BwINHHYJ\nnKTr1COw+XzhwzoRzaWt+MvAqoZ+90S41GmqGfV6s3g6f+Ou9PChjgC1ipGt\npirGNxjPnWlmoytQik6BJbWiHCBYRYWtFQARAQABwsBfBBgBCAATBQJZgRLW\nCRAK77Qge/sL8gIbDAAAfBwH/17bcGnFDcGb409wekzja51CRW/E3s+80l/4\nBLrC+qXp/eO/cdN1ymgzqsswBIE2Ror51rhmeTGw67lG6KJYGuoY524Iycwx\nB0G80phGqgrTkvhIyH5QH9wmm8I53slu1HTZRd5AdF6/WUxbafHY5NJlpYEb\nv9AhnGZ2GSBJQ9Q9hQb0EHzG/52pMO/1rpIraG07xlOXwM64u5nwhxLEmQj9\nz9E9xmfl9wZxqzEExtWcinblj7ZCtcdgOfLqHMH0ZGSBGg0bMr5tOjJ8rT3Z\nXtsv+1BXdAHMylzomWlU6fcog2t4uRKTTq5CTBzt5spsgncTR6awXuQ1Fro1\nmzY7//s=\r\n=mmUg\r\n-----END PGP PUBLIC KEY BLOCK-----\r\n\r\n"
+
+func TestGraph(t *testing.T) {
+	chain := trustedKeyables
+	chain.PinnedRoots = trust.Pins{{Id: "owner-id", Fingerprint: fingerprint(ownerPubkey)}}
+	graph := chain.Graph(adminSigner, devInheritanceSigner)
+
+	nodes := make(map[string]*trust.Node)
+	for _, node := range graph.Nodes {
+		nodes[node.Id] = node
+	}
+	assert.Len(t, nodes, 4, "Should include each keyable once.")
+
+	owner := nodes["owner-id"]
+	assert.True(t, owner.Root, "Should mark creator trusted keyables as roots.")
+	assert.True(t, owner.Pinned, "Should mark pinned roots.")
+	assert.Equal(t, []string{trust.SourceCreator}, owner.Sources)
+
+	admin := nodes["admin-id"]
+	assert.Equal(t, []string{trust.SourceSigner, trust.SourceInheritance}, admin.Sources, "Should list every map a keyable is in.")
+	assert.Equal(t, fingerprint(adminPubkey), admin.Fingerprint)
+	assert.True(t, admin.Trusted, "Should be trusted.")
+	assert.True(t, admin.Signer, "Should mark the signer.")
+	assert.True(t, nodes["dev-id"].InheritanceSigner, "Should mark the inheritance overrides signer.")
+
+	invalidAdmin := nodes["invalid-admin-id"]
+	assert.False(t, invalidAdmin.Trusted, "Should not be trusted.")
+	assert.NotEqual(t, "", invalidAdmin.Error, "Should record why.")
+
+	edges := make(map[string]*trust.Edge)
+	for _, edge := range graph.Edges {
+		edges[edge.From+"->"+edge.To+":"+edge.Source] = edge
+	}
+	assert.Len(t, edges, 4, "Should include an edge per invite in each map.")
+	assert.True(t, edges["admin-id->owner-id:signer"].Verified, "Should verify the invite.")
+	assert.True(t, edges["dev-id->admin-id:inheritance"].Verified, "Should verify the invite.")
+	assert.Len(t, edges["dev-id->admin-id:inheritance"].Checks, 2, "Should record the invite checks.")
+	assert.False(t, edges["invalid-admin-id->admin-id:signer"].Verified, "Should not verify the invite.")
+
+	dot := graph.DOT()
+	assert.Contains(t, dot, `"dev-id" -> "admin-id" [label="inheritance", color=darkgreen];`)
+	assert.Contains(t, dot, `"invalid-admin-id" -> "admin-id" [label="signer: No signature by signer found.", color=red, style=dashed];`)
+}
+
+func TestVerifiedLinks(t *testing.T) {
+	var explanation *trust.Explanation
+	var err error
+
+	links := trust.NewVerifiedLinks()
+	chain := trustedKeyables
+	chain.VerifiedLinks = links
+
+	_, _, explanation, err = chain.SignerTrustedKeyable(devInheritanceSigner)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, 2, links.Len(), "Should record each verified invitation.")
+	assert.False(t, explanation.Path[0].Checks[2].Memoized, "Should verify the first time.")
+
+	_, _, explanation, err = chain.SignerTrustedKeyable(devInheritanceSigner)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.True(t, explanation.Path[0].Checks[2].Memoized, "Should skip verified invitations.")
+	assert.True(t, explanation.Path[1].Checks[0].Memoized, "Should skip verified invitations.")
+
+	// A changed invite key is verified again
+	changedDev := dev
+	changedDev.InvitePubkeyArmored = invalidInvitePubkey
+	changed := chain
+	changed.InheritanceOverridesSignerTrusted = trust.TrustedKeyablesMap{"admin-id": admin, "dev-id": changedDev}
+	_, _, explanation, err = changed.SignerTrustedKeyable(devInheritanceSigner)
+	assert.NotNil(t, err, "Should verify the changed invitation.")
+	assert.Equal(t, "dev-id", explanation.BrokenAt)
+
+	secret := []byte("secret")
+	data, err := links.MarshalSigned(secret)
+	assert.Nil(t, err, "Should not return an error.")
+
+	read, err := trust.UnmarshalVerifiedLinks(data, secret)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.Equal(t, 2, read.Len(), "Should read the links.")
+
+	_, err = trust.UnmarshalVerifiedLinks(data, []byte("other secret"))
+	assert.Equal(t, trust.ErrVerifiedLinksTampered, err, "Should reject links signed with another secret.")
+
+	tampered := strings.Replace(string(data), `"verifiedAt":"`, `"verifiedAt":"1`, 1)
+	_, err = trust.UnmarshalVerifiedLinks([]byte(tampered), secret)
+	assert.Equal(t, trust.ErrVerifiedLinksTampered, err, "Should reject modified links.")
+
+	merged := trust.NewVerifiedLinks()
+	merged.Merge(read)
+	chain.VerifiedLinks = merged
+	_, _, explanation, err = chain.SignerTrustedKeyable(devInheritanceSigner)
+	assert.Nil(t, err, "Should not return an error.")
+	assert.True(t, explanation.Path[0].Checks[2].Memoized, "Should use persisted links.")
+}
+
+type syntheticKeyable struct {
+	invitedBy string
+	// signedBy certifies the invite key when it isn't the inviter
+	signedBy string
+}
+
+// syntheticChain generates a key and invite key for each keyable and certifies
+// them so that "root" is creator trusted and the rest are signer trusted.
+func syntheticChain(t *testing.T, keyables map[string]syntheticKeyable) trust.TrustedKeyablesChain {
+	config := &packet.Config{
+		Algorithm: packet.PubKeyAlgoEdDSA,
+		Time:      func() time.Time { return time.Now().Add(-time.Minute) },
+	}
+
+	newEntity := func(name string) *openpgp.Entity {
+		entity, err := openpgp.NewEntity(name, "", name+"@envkey.com", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entity
+	}
+	armored := func(entity *openpgp.Entity) string {
+		var b bytes.Buffer
+		w, _ := armor.Encode(&b, openpgp.PublicKeyType, nil)
+		entity.Serialize(w)
+		w.Close()
+		return b.String()
+	}
+	identity := func(entity *openpgp.Entity) string {
+		for name := range entity.Identities {
+			return name
+		}
+		return ""
+	}
+
+	keys := map[string]*openpgp.Entity{"root": newEntity("root")}
+	invites := make(map[string]*openpgp.Entity)
+	for id := range keyables {
+		keys[id] = newEntity(id)
+		invites[id] = newEntity(id + "-invite")
+	}
+
+	chain := trust.TrustedKeyablesChain{
+		CreatorTrusted: trust.TrustedKeyablesMap{"root": {PubkeyArmored: armored(keys["root"])}},
+		SignerTrusted:  trust.TrustedKeyablesMap{},
+	}
+	for id, keyable := range keyables {
+		signedBy := keyable.signedBy
+		if signedBy == "" {
+			signedBy = keyable.invitedBy
+		}
+		if signer, ok := keys[signedBy]; ok {
+			invites[id].SignIdentity(identity(invites[id]), signer, config)
+		}
+		keys[id].SignIdentity(identity(keys[id]), invites[id], config)
+	}
+	for id, keyable := range keyables {
+		chain.SignerTrusted[id] = trust.TrustedKeyable{PubkeyArmored: armored(keys[id]), InvitePubkeyArmored: armored(invites[id]), InvitedById: keyable.invitedBy}
+	}
+	return chain
+}
+
+func TestTrustChainWalk(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyables map[string]syntheticKeyable
+		maxDepth int
+		err      error
+		brokenAt string
+		message  string
+	}{
+		{
+			name:     "valid chain",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "root"}, "b": {invitedBy: "a"}, "signer": {invitedBy: "b"}},
+		},
+		{
+			name:     "self invited",
+			keyables: map[string]syntheticKeyable{"signer": {invitedBy: "signer"}},
+			err:      trust.ErrCycle,
+			brokenAt: "signer",
+			message:  "Trust chain has a cycle: signer -> signer.",
+		},
+		{
+			name:     "cycle through signer",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "signer"}, "signer": {invitedBy: "a"}},
+			err:      trust.ErrCycle,
+			brokenAt: "a",
+			message:  "Trust chain has a cycle: signer -> a -> signer.",
+		},
+		{
+			name:     "cycle above signer",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "b"}, "b": {invitedBy: "a"}, "signer": {invitedBy: "a"}},
+			err:      trust.ErrCycle,
+			brokenAt: "b",
+			message:  "Trust chain has a cycle: signer -> a -> b -> a.",
+		},
+		{
+			name:     "missing inviter",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "ghost"}, "signer": {invitedBy: "a"}},
+			err:      trust.ErrMissingInviter,
+			brokenAt: "ghost",
+			message:  "Inviter ghost of a not trusted.",
+		},
+		{
+			name:     "no inviter",
+			keyables: map[string]syntheticKeyable{"a": {}, "signer": {invitedBy: "a"}},
+			err:      trust.ErrMissingInviter,
+			brokenAt: "a",
+			message:  "No inviter for a.",
+		},
+		{
+			name:     "bad signature",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "root"}, "signer": {invitedBy: "a", signedBy: "root"}},
+			err:      trust.ErrBadSignature,
+			brokenAt: "signer",
+		},
+		{
+			name:     "within max depth",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "root"}, "b": {invitedBy: "a"}, "signer": {invitedBy: "b"}},
+			maxDepth: 3,
+		},
+		{
+			name:     "exceeds max depth",
+			keyables: map[string]syntheticKeyable{"a": {invitedBy: "root"}, "b": {invitedBy: "a"}, "signer": {invitedBy: "b"}},
+			maxDepth: 2,
+			err:      trust.ErrMaxDepth,
+			brokenAt: "a",
+			message:  "Trust chain longer than 2 invitations at a.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := syntheticChain(t, test.keyables)
+			chain.MaxDepth = test.maxDepth
+			signer, err := trust.NewSigner("signer", chain.SignerTrusted["signer"].PubkeyArmored, false)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			_, _, explanation, err := chain.SignerTrustedKeyable(signer)
+			if test.err == nil {
+				assert.Nil(t, err, "Should not return an error.")
+				assert.True(t, explanation.Trusted, "Should be trusted.")
+				return
+			}
+
+			assert.ErrorIs(t, err, test.err)
+			var chainErr *trust.ChainError
+			if assert.ErrorAs(t, err, &chainErr) {
+				assert.Equal(t, "signer", chainErr.Path[0], "Should record the path from the signer.")
+			}
+			assert.Equal(t, test.brokenAt, explanation.BrokenAt, "Should record where the chain broke.")
+			if test.message != "" {
+				assert.Equal(t, test.message, err.Error())
+			}
+		})
+	}
+
+	// The underlying verification error is kept
+	chain := syntheticChain(t, map[string]syntheticKeyable{"signer": {invitedBy: "root", signedBy: "other"}, "other": {invitedBy: "root"}})
+	signer, _ := trust.NewSigner("signer", chain.SignerTrusted["signer"].PubkeyArmored, false)
+	_, _, _, err := chain.SignerTrustedKeyable(signer)
+	var chainErr *trust.ChainError
+	if assert.ErrorAs(t, err, &chainErr) {
+		assert.Equal(t, trust.ErrBadSignature, chainErr.Err)
+		assert.NotNil(t, chainErr.Cause, "Should keep the verification error.")
+		assert.Equal(t, "root", chainErr.InviterId)
+	}
+}
@@ -0,0 +1,153 @@
+package trust
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultMaxDepth is the maximum number of invitations followed from a signer
+// to its root when a chain doesn't set MaxDepth.
+const DefaultMaxDepth = 16
+
+var (
+	ErrCycle          = errors.New("Trust chain has a cycle.")
+	ErrMissingInviter = errors.New("Inviter not trusted.")
+	ErrBadSignature   = errors.New("Invite signature invalid.")
+	ErrMaxDepth       = errors.New("Trust chain too deep.")
+)
+
+// ChainError reports where walking a trust chain failed. Err is one of
+// ErrCycle, ErrMissingInviter, ErrBadSignature or ErrMaxDepth, and Cause is
+// the underlying verification error for a bad signature. Path holds the ids
+// walked so far, starting from the signer.
+type ChainError struct {
+	Err       error
+	Id        string
+	InviterId string
+	Path      []string
+	MaxDepth  int
+	Cause     error
+}
+
+func (err *ChainError) Error() string {
+	id := err.Id
+	if id == "" {
+		id = "keyable"
+	}
+	switch err.Err {
+	case ErrCycle:
+		return fmt.Sprintf("Trust chain has a cycle: %s.", strings.Join(append(append([]string{}, err.Path...), err.InviterId), " -> "))
+	case ErrMissingInviter:
+		if err.InviterId == "" {
+			return fmt.Sprintf("No inviter for %s.", id)
+		}
+		return fmt.Sprintf("Inviter %s of %s not trusted.", err.InviterId, id)
+	case ErrBadSignature:
+		return fmt.Sprintf("Invite of %s by %s invalid: %s", id, err.InviterId, err.Cause)
+	case ErrMaxDepth:
+		return fmt.Sprintf("Trust chain longer than %d invitations at %s.", err.MaxDepth, id)
+	}
+	return err.Err.Error()
+}
+
+func (err *ChainError) Unwrap() []error {
+	if err.Cause == nil {
+		return []error{err.Err}
+	}
+	return []error{err.Err, err.Cause}
+}
+
+// chainWalk follows invitations from a signer towards a root, recording each
+// keyable visited so that revisiting one is reported as a cycle rather than
+// looping, and bounding the number of invitations followed.
+type chainWalk struct {
+	creatorTrusted TrustedKeyablesMap
+	now            time.Time
+	source         string
+	explanation    *Explanation
+	links          *VerifiedLinks
+	maxDepth       int
+	path           []string
+	visited        map[string]bool
+}
+
+func newChainWalk(creatorTrusted TrustedKeyablesMap, now time.Time, source string, explanation *Explanation, links *VerifiedLinks, maxDepth int) *chainWalk {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	walk := &chainWalk{
+		creatorTrusted: creatorTrusted,
+		now:            now,
+		source:         source,
+		explanation:    explanation,
+		links:          links,
+		maxDepth:       maxDepth,
+		visited:        make(map[string]bool),
+	}
+	// The walk starts at the keyable of the explanation's last step
+	if len(explanation.Path) > 0 {
+		walk.visit(explanation.Path[len(explanation.Path)-1].Id)
+	}
+	return walk
+}
+
+func (walk *chainWalk) visit(id string) {
+	walk.path = append(walk.path, id)
+	if id != "" {
+		walk.visited[id] = true
+	}
+}
+
+func (walk *chainWalk) chainError(err error, id, inviterId string, cause error) *ChainError {
+	return &ChainError{
+		Err:       err,
+		Id:        id,
+		InviterId: inviterId,
+		Path:      append([]string{}, walk.path...),
+		MaxDepth:  walk.maxDepth,
+		Cause:     cause,
+	}
+}
+
+// inviter looks up the inviter of the keyable with id, in creatorTrusted first
+// and then in trustedKeyables, and adds it to the path and explanation.
+func (walk *chainWalk) inviter(id string, keyable *TrustedKeyable, trustedKeyables TrustedKeyablesMap) (string, *TrustedKeyable, *Step, error) {
+	inviterId := keyable.InvitedById
+	if inviterId == "" {
+		return "", nil, nil, walk.explanation.fail(id, walk.chainError(ErrMissingInviter, id, "", nil))
+	}
+	if walk.visited[inviterId] {
+		return "", nil, nil, walk.explanation.fail(id, walk.chainError(ErrCycle, id, inviterId, nil))
+	}
+	if len(walk.path) > walk.maxDepth {
+		return "", nil, nil, walk.explanation.fail(id, walk.chainError(ErrMaxDepth, id, inviterId, nil))
+	}
+
+	source := SourceCreator
+	inviterKeyable, ok := walk.creatorTrusted[inviterId]
+	if !ok {
+		source = walk.source
+		inviterKeyable, ok = trustedKeyables[inviterId]
+	}
+	if !ok {
+		walk.explanation.step(inviterId, "", nil)
+		return "", nil, nil, walk.explanation.fail(inviterId, walk.chainError(ErrMissingInviter, id, inviterId, nil))
+	}
+
+	walk.visit(inviterId)
+	inviterStep := walk.explanation.step(inviterId, source, &inviterKeyable)
+	inviterStep.Root = source == SourceCreator
+	return inviterId, &inviterKeyable, inviterStep, nil
+}
+
+// verify checks the invitation of the keyable at step by the inviter at
+// inviterStep, recording the checks on step.
+func (walk *chainWalk) verify(keyable, inviter *TrustedKeyable, step, inviterStep *Step) error {
+	err := walk.links.verifyInviter(keyable, inviter, step.Fingerprint, inviterStep.Fingerprint, walk.now, step)
+	if err != nil {
+		return walk.explanation.fail(step.Id, walk.chainError(ErrBadSignature, step.Id, inviterStep.Id, err))
+	}
+	return nil
+}